@@ -0,0 +1,308 @@
+// integration_test.go
+
+//go:build integration
+
+// The integration tests run the orchestrator binary against MongoDB and
+// Mosquitto containers, and are skipped without a Docker daemon:
+//
+//	go test -tags integration .
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testDatabase   = "iot_mesh"
+	testCollection = "sensor_data"
+)
+
+var (
+	buildOnce   sync.Once
+	binary      string
+	errBuild    error
+	buildOutput []byte
+)
+
+// orchestratorBinary builds the orchestrator once for all tests.
+func orchestratorBinary(t *testing.T) string {
+	t.Helper()
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "orchestrator-integration")
+		if err != nil {
+			errBuild = err
+			return
+		}
+		binary = filepath.Join(dir, "orchestrator")
+		buildOutput, errBuild = exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	})
+	if errBuild != nil {
+		t.Fatalf("build orchestrator: %v\n%s", errBuild, buildOutput)
+	}
+	return binary
+}
+
+// stack is a broker and a database for one test.
+type stack struct {
+	brokerHost, brokerPort string
+	mongoURI               string
+	db                     *mongo.Database
+}
+
+// startStack starts throwaway Mosquitto and MongoDB containers, removed when
+// the test ends.
+func startStack(t *testing.T) stack {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+
+	broker, err := testcontainers.Run(ctx, "eclipse-mosquitto:2",
+		testcontainers.WithCmd("mosquitto", "-c", "/mosquitto-no-auth.conf"),
+		testcontainers.WithExposedPorts("1883/tcp"),
+		testcontainers.WithWaitStrategy(wait.ForListeningPort("1883/tcp")),
+	)
+	testcontainers.CleanupContainer(t, broker)
+	if err != nil {
+		t.Fatalf("start mosquitto: %v", err)
+	}
+	database, err := testcontainers.Run(ctx, "mongo:7",
+		testcontainers.WithExposedPorts("27017/tcp"),
+		testcontainers.WithWaitStrategy(wait.ForLog("Waiting for connections")),
+	)
+	testcontainers.CleanupContainer(t, database)
+	if err != nil {
+		t.Fatalf("start mongodb: %v", err)
+	}
+
+	var s stack
+	if s.brokerHost, err = broker.Host(ctx); err != nil {
+		t.Fatalf("mosquitto host: %v", err)
+	}
+	port, err := broker.MappedPort(ctx, "1883/tcp")
+	if err != nil {
+		t.Fatalf("mosquitto port: %v", err)
+	}
+	s.brokerPort = port.Port()
+	endpoint, err := database.PortEndpoint(ctx, "27017/tcp", "mongodb")
+	if err != nil {
+		t.Fatalf("mongodb endpoint: %v", err)
+	}
+	s.mongoURI = endpoint + "/?directConnection=true"
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(s.mongoURI))
+	if err != nil {
+		t.Fatalf("connect to mongodb: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	s.db = client.Database(testDatabase)
+	return s
+}
+
+// runOrchestrator runs the orchestrator against s with env on top of the
+// settings every test needs, and waits until it is ready. It is stopped with
+// SIGTERM when the test ends, and its log is shown if the test failed.
+func runOrchestrator(t *testing.T, s stack, env map[string]string) {
+	t.Helper()
+	healthPort := freePort(t)
+	settings := map[string]string{
+		"MQTT_BROKER":        s.brokerHost,
+		"MQTT_PORT":          s.brokerPort,
+		"MQTT_TOPIC":         "mesh/data/",
+		"MONGO_URI":          s.mongoURI,
+		"MONGO_DATABASE":     testDatabase,
+		"MONGO_COLLECTION":   testCollection,
+		"PARSE_JSON_PAYLOAD": "true",
+		"BATCH_SIZE":         "1",
+		"HEALTH_PORT":        healthPort,
+		"METRICS_PORT":       freePort(t),
+	}
+	for key, value := range env {
+		settings[key] = value
+	}
+
+	var log bytes.Buffer
+	cmd := exec.Command(orchestratorBinary(t))
+	cmd.Env = os.Environ()
+	for key, value := range settings {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout, cmd.Stderr = &log, &log
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start orchestrator: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("orchestrator exited: %v", err)
+		}
+		if t.Failed() {
+			t.Logf("orchestrator log:\n%s", log.String())
+		}
+	})
+
+	ready := "http://localhost:" + healthPort + "/readyz"
+	eventually(t, 30*time.Second, func() bool {
+		resp, err := http.Get(ready)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+}
+
+// publish publishes payload on topic with QoS 1. It is retained, so that
+// the orchestrator gets it even if /readyz reported the broker connection
+// before the subscription was in place.
+func publish(t *testing.T, s stack, topic, payload string) {
+	t.Helper()
+	opts := mqtt.NewClientOptions().
+		AddBroker(fmt.Sprintf("tcp://%s:%s", s.brokerHost, s.brokerPort)).
+		SetClientID("integration-test-publisher")
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect publisher: %v", token.Error())
+	}
+	defer client.Disconnect(250)
+	if token := client.Publish(topic, 1, true, payload); token.Wait() && token.Error() != nil {
+		t.Fatalf("publish: %v", token.Error())
+	}
+}
+
+// findReading waits for the reading of deviceID to be stored and returns it.
+func findReading(t *testing.T, s stack, deviceID string) bson.M {
+	t.Helper()
+	var doc bson.M
+	eventually(t, 30*time.Second, func() bool {
+		err := s.db.Collection(testCollection).FindOne(context.Background(), bson.M{"device_id": deviceID}).Decode(&doc)
+		return err == nil
+	})
+	return doc
+}
+
+// eventually polls cond until it holds, failing the test after timeout.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// freePort returns a TCP port that was free a moment ago.
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("find free port: %v", err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestIntegrationStoresReading(t *testing.T) {
+	s := startStack(t)
+	runOrchestrator(t, s, nil)
+
+	publish(t, s, "mesh/data/sensor-1", `{"temperature":21.5}`)
+	doc := findReading(t, s, "sensor-1")
+
+	if got := doc["payload"]; got != `{"temperature":21.5}` {
+		t.Errorf("payload = %v, want the raw message", got)
+	}
+	payloadJSON, ok := doc["payload_json"].(bson.M)
+	if !ok {
+		t.Fatalf("payload_json = %#v, want a document", doc["payload_json"])
+	}
+	if got := payloadJSON["temperature"]; got != 21.5 {
+		t.Errorf("payload_json.temperature = %v, want 21.5", got)
+	}
+	for _, field := range []string{"timestamp", "received_at"} {
+		if _, ok := doc[field].(primitive.DateTime); !ok {
+			t.Errorf("%s = %#v, want a date", field, doc[field])
+		}
+	}
+	if id, ok := doc["message_id"].(string); !ok || id == "" {
+		t.Errorf("message_id = %#v, want a UUID", doc["message_id"])
+	}
+	if _, ok := doc["encrypted"]; ok {
+		t.Errorf("encrypted is set without ENCRYPTION")
+	}
+}
+
+func TestIntegrationEncryptsReading(t *testing.T) {
+	// The mock Cipher API "encrypts" a text by prefixing it, and records
+	// what it was sent.
+	var (
+		mu    sync.Mutex
+		texts []string
+	)
+	cipher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/encrypt" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		texts = append(texts, req.Text)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"result": "sealed:" + req.Text})
+	}))
+	t.Cleanup(cipher.Close)
+
+	s := startStack(t)
+	runOrchestrator(t, s, map[string]string{
+		"ENCRYPTION":      "true",
+		"ENCRYPT_API_URL": cipher.URL,
+	})
+
+	publish(t, s, "mesh/data/sensor-2", `{"humidity":40}`)
+	doc := findReading(t, s, "sensor-2")
+
+	if got := doc["payload"]; got != `sealed:{"humidity":40}` {
+		t.Errorf("payload = %v, want the Cipher API result", got)
+	}
+	if got := doc["encrypted"]; got != true {
+		t.Errorf("encrypted = %v, want true", got)
+	}
+	if _, ok := doc["payload_json"]; ok {
+		t.Errorf("payload_json is stored next to the ciphertext")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(texts) != 1 || texts[0] != `{"humidity":40}` {
+		t.Errorf("Cipher API got %q, want the plaintext payload once", texts)
+	}
+}
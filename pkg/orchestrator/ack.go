@@ -0,0 +1,42 @@
+// ack.go
+package orchestrator
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// storeAck is published to {ACK_TOPIC_PREFIX}/{device_id} once a reading is
+// stored.
+type storeAck struct {
+	DeviceID  string    `json:"device_id"`
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// publishAcks acknowledges stored readings in the background so a slow
+// broker does not hold up the writer.
+func (o *Orchestrator) publishAcks(stored []SensorData) {
+	if o.cfg.AckTopicPrefix == "" || o.client == nil || len(stored) == 0 {
+		return
+	}
+
+	acks := make([]storeAck, len(stored))
+	for i, data := range stored {
+		acks[i] = storeAck{DeviceID: data.DeviceID, ID: data.ID.Hex(), MessageID: data.MessageID, Timestamp: data.Timestamp}
+	}
+	go func() {
+		for _, ack := range acks {
+			body, err := json.Marshal(ack)
+			if err != nil {
+				continue
+			}
+			topic := o.cfg.AckTopicPrefix + "/" + ack.DeviceID
+			if err := o.client.Publish(topic, o.cfg.AckQoS, false, string(body)); err != nil {
+				slog.Warn("Ack publish failed", "component", "mqtt", "topic", topic, "error", err)
+			}
+		}
+	}()
+}
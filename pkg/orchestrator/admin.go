@@ -0,0 +1,157 @@
+// admin.go
+package orchestrator
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+)
+
+// authorizeAdmin rejects requests that do not bear ADMIN_TOKEN, since the
+// admin and debug endpoints share the otherwise unauthenticated HEALTH_PORT.
+func (o *Orchestrator) authorizeAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+o.cfg.AdminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// reloadResult reports what POST /admin/reload changed. Settings are named
+// by their Config field.
+type reloadResult struct {
+	Applied []string `json:"applied"`
+	// RestartRequired lists changed settings that cannot be swapped at
+	// runtime and keep their old value until the next restart.
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// handleReload re-reads the environment and CONFIG_FILE and applies the
+// settings that are safe to change while running: LOG_LEVEL, the rate
+// limits, TRANSFORM_RULES and the topic subscriptions. An invalid
+// configuration is rejected as a whole.
+func (o *Orchestrator) handleReload(w http.ResponseWriter, r *http.Request) {
+	next, err := LoadConfig()
+	if err != nil {
+		slog.Warn("Config reload rejected", "component", "admin", "error", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	o.reloadMu.Lock()
+	defer o.reloadMu.Unlock()
+
+	live := o.applied
+	result := reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	if next.LogLevel != live.LogLevel {
+		logLevel.Set(next.LogLevel)
+		live.LogLevel = next.LogLevel
+		result.Applied = append(result.Applied, "LogLevel")
+	}
+	if next.RateLimit != live.RateLimit || next.RateBurst != live.RateBurst {
+		o.setRateLimit(next.RateLimit, next.RateBurst)
+		if next.RateLimit != live.RateLimit {
+			result.Applied = append(result.Applied, "RateLimit")
+		}
+		if next.RateBurst != live.RateBurst {
+			result.Applied = append(result.Applied, "RateBurst")
+		}
+		live.RateLimit, live.RateBurst = next.RateLimit, next.RateBurst
+	}
+	if !reflect.DeepEqual(next.TransformRules, live.TransformRules) {
+		o.transformRules.Store(next.TransformRules)
+		live.TransformRules = next.TransformRules
+		result.Applied = append(result.Applied, "TransformRules")
+	}
+	if !slices.Equal(next.Subscriptions, live.Subscriptions) {
+		if err := o.resubscribe(live.Subscriptions, next.Subscriptions); err != nil {
+			slog.Error("Resubscribe failed", "component", "admin", "error", err)
+			result.Error = "resubscribe failed: " + err.Error()
+		}
+		live.Subscriptions = next.Subscriptions
+		result.Applied = append(result.Applied, "Subscriptions")
+	}
+	o.applied = live
+
+	result.RestartRequired = append(result.RestartRequired, changedFields(live, next)...)
+	slog.Info("Config reloaded", "component", "admin", "applied", result.Applied, "restart_required", result.RestartRequired)
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
+
+// resubscribe moves the broker subscriptions from prev to next. The new list
+// is used for reconnects straight away, so it also takes effect when the
+// broker is unreachable right now.
+func (o *Orchestrator) resubscribe(prev, next []subscription) error {
+	o.subsMu.Lock()
+	o.subs = next
+	o.subsMu.Unlock()
+
+	kept := make(map[string]byte, len(next))
+	for _, sub := range next {
+		kept[sub.Filter] = sub.QoS
+	}
+	old := make(map[string]byte, len(prev))
+	var removed []string
+	for _, sub := range prev {
+		old[sub.Filter] = sub.QoS
+		if _, ok := kept[sub.Filter]; !ok {
+			removed = append(removed, sub.Filter)
+		}
+	}
+	var added []subscription
+	for _, sub := range next {
+		if qos, ok := old[sub.Filter]; !ok || qos != sub.QoS {
+			added = append(added, sub)
+		}
+	}
+
+	if len(removed) > 0 {
+		filters := make([]string, len(removed))
+		for i, filter := range removed {
+			filters[i] = o.brokerFilter(filter)
+		}
+		if err := o.client.Unsubscribe(filters); err != nil {
+			return err
+		}
+		for _, filter := range filters {
+			subscriptionGrantedQoS.DeleteLabelValues(filter)
+		}
+		slog.Info("Unsubscribed", "component", "mqtt", "topics", removed)
+	}
+	if len(added) > 0 {
+		subs := o.brokerSubscriptions(added)
+		granted, err := o.client.Subscribe(subs)
+		if err == nil {
+			err = o.checkGrantedQoS(subs, granted)
+		}
+		if err != nil {
+			return err
+		}
+		for _, sub := range added {
+			slog.Info("Subscribed", "component", "mqtt", "topic", sub.Filter, "qos", sub.QoS)
+		}
+	}
+	return nil
+}
+
+// changedFields returns the names of the Config fields that differ.
+func changedFields(a, b Config) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var names []string
+	for i := range va.NumField() {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, va.Type().Field(i).Name)
+		}
+	}
+	return names
+}
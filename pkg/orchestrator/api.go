@@ -0,0 +1,255 @@
+// api.go
+package orchestrator
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// startAPIServer serves the read-back API on listener, for cfg.APIPort.
+func (o *Orchestrator) startAPIServer(listener net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /devices/{id}/latest", o.handleDeviceLatest)
+	mux.HandleFunc("GET /devices/{id}/data", o.handleDeviceData)
+
+	server := &http.Server{Addr: ":" + o.cfg.APIPort, Handler: o.authorizeAPI(mux)}
+	o.serve("api", server, listener)
+	slog.Info("Listening", "component", "api", "port", o.cfg.APIPort)
+	return server
+}
+
+// authorizeAPI rejects requests that do not bear API_TOKEN, since the API
+// returns decrypted payloads.
+func (o *Orchestrator) authorizeAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+o.cfg.APIToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleDeviceLatest returns the most recent reading of a device, decrypting
+// the payload through the cipher API when encryption is enabled.
+func (o *Orchestrator) handleDeviceLatest(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	data, err := o.findLatest(ctx, deviceID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no data for device " + deviceID})
+		return
+	}
+	if err != nil {
+		slog.Error("Lookup failed", "component", "api", "device_id", deviceID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "lookup failed"})
+		return
+	}
+
+	if o.cfg.Encryption {
+		if data, err = o.decryptReading(ctx, data); err != nil {
+			slog.Error("Decrypt failed", "component", "cipher", "device_id", deviceID, "error", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "decryption failed"})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
+
+// findLatest reads the device's reading from LATEST_COLLECTION when it is
+// configured and falls back to the newest document in the data collection.
+func (o *Orchestrator) findLatest(ctx context.Context, deviceID string) (SensorData, error) {
+	o.mongoMu.RLock()
+	collection := o.dataCollection
+	if o.latestCollection != nil {
+		collection = o.latestCollection
+	}
+	o.mongoMu.RUnlock()
+
+	var data SensorData
+	if collection == nil {
+		return data, errors.New("not connected")
+	}
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	err := collection.FindOne(ctx, bson.M{"device_id": deviceID}, opts).Decode(&data)
+	return data, err
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+	// maxHistoryWindow caps offset+limit, which is how many readings each
+	// collection is asked for.
+	maxHistoryWindow = 10000
+)
+
+// historyQuery holds the parsed query string of GET /devices/{id}/data.
+type historyQuery struct {
+	From, To      time.Time
+	Limit, Offset int
+}
+
+// parseHistoryQuery reads from/to (RFC 3339, both optional), limit and offset
+// from q.
+func parseHistoryQuery(q url.Values) (historyQuery, error) {
+	hq := historyQuery{Limit: defaultHistoryLimit}
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{{"from", &hq.From}, {"to", &hq.To}} {
+		if v := q.Get(p.key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return hq, fmt.Errorf("%s: %q is not an RFC 3339 timestamp", p.key, v)
+			}
+			*p.dst = t
+		}
+	}
+	if !hq.From.IsZero() && !hq.To.IsZero() && hq.To.Before(hq.From) {
+		return hq, errors.New("to is before from")
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			return hq, fmt.Errorf("limit: must be between 1 and %d", maxHistoryLimit)
+		}
+		hq.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return hq, errors.New("offset: must be a non-negative integer")
+		}
+		hq.Offset = n
+	}
+	if hq.Offset+hq.Limit > maxHistoryWindow {
+		return hq, fmt.Errorf("offset: offset plus limit must be at most %d", maxHistoryWindow)
+	}
+	return hq, nil
+}
+
+// handleDeviceData returns a page of a device's readings, newest first.
+func (o *Orchestrator) handleDeviceData(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	hq, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	readings, err := o.findHistory(ctx, deviceID, hq)
+	if err != nil {
+		slog.Error("Query failed", "component", "api", "device_id", deviceID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "query failed"})
+		return
+	}
+
+	if o.cfg.Encryption {
+		for i := range readings {
+			readings[i], err = o.decryptReading(ctx, readings[i])
+			if err != nil {
+				slog.Error("Decrypt failed", "component", "cipher", "device_id", deviceID, "error", err)
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": "decryption failed"})
+				return
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, readings)
+}
+
+// findHistory queries every data collection, including the ROUTE_BY_FIELD
+// collections that exist, for the device's readings in
+// the requested time range, sorted by timestamp descending. With several
+// collections, each is asked for its first offset+limit matches, which are
+// merged before the page is cut.
+func (o *Orchestrator) findHistory(ctx context.Context, deviceID string, hq historyQuery) ([]SensorData, error) {
+	o.mongoMu.RLock()
+	connected := o.dataCollection != nil
+	o.mongoMu.RUnlock()
+	if !connected {
+		return nil, errors.New("not connected")
+	}
+
+	filter := bson.M{"device_id": deviceID}
+	ts := bson.M{}
+	if !hq.From.IsZero() {
+		ts["$gte"] = hq.From
+	}
+	if !hq.To.IsZero() {
+		ts["$lte"] = hq.To
+	}
+	if len(ts) > 0 {
+		filter["timestamp"] = ts
+	}
+
+	names := o.dataCollectionNames()
+	routed, err := o.routedCollectionNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range routed {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	if len(names) == 1 {
+		opts.SetSkip(int64(hq.Offset)).SetLimit(int64(hq.Limit))
+	} else {
+		opts.SetLimit(int64(hq.Offset + hq.Limit))
+	}
+
+	// Always encode an array, even when nothing matched.
+	readings := []SensorData{}
+	for _, name := range names {
+		cursor, err := o.dataCollectionFor(name).Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		var found []SensorData
+		if err := cursor.All(ctx, &found); err != nil {
+			return nil, err
+		}
+		readings = append(readings, found...)
+	}
+	if len(names) == 1 {
+		return readings, nil
+	}
+
+	slices.SortStableFunc(readings, func(a, b SensorData) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	readings = readings[min(hq.Offset, len(readings)):]
+	return readings[:min(hq.Limit, len(readings))], nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
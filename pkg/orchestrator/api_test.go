@@ -0,0 +1,57 @@
+// api_test.go
+package orchestrator
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryQuery(t *testing.T) {
+	from := time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		query   string
+		want    historyQuery
+		wantErr string
+	}{
+		{name: "defaults", query: "", want: historyQuery{Limit: defaultHistoryLimit}},
+		{
+			name:  "all parameters",
+			query: "from=2024-05-16T00:00:00Z&to=2024-05-17T00:00:00Z&limit=50&offset=100",
+			want:  historyQuery{From: from, To: to, Limit: 50, Offset: 100},
+		},
+		{name: "from only", query: "from=2024-05-16T00:00:00Z", want: historyQuery{From: from, Limit: defaultHistoryLimit}},
+		{name: "bad timestamp", query: "from=yesterday", wantErr: "from:"},
+		{name: "to before from", query: "from=2024-05-17T00:00:00Z&to=2024-05-16T00:00:00Z", wantErr: "to is before from"},
+		{name: "zero limit", query: "limit=0", wantErr: "limit:"},
+		{name: "limit too large", query: "limit=1001", wantErr: "limit:"},
+		{name: "negative offset", query: "offset=-1", wantErr: "offset:"},
+		{name: "offset not a number", query: "offset=ten", wantErr: "offset:"},
+		{name: "largest window", query: "limit=1000&offset=9000", want: historyQuery{Limit: 1000, Offset: 9000}},
+		{name: "window too large", query: "limit=1000&offset=9001", wantErr: "offset plus limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseHistoryQuery(q)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("query = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// batch.go
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func (o *Orchestrator) startBatchWriter() {
+	o.batchQueue = make(chan SensorData, o.cfg.BatchSize)
+	go o.runBatchWriter(o.cfg.BatchSize, o.cfg.BatchInterval)
+	slog.Info("Writer started", "component", "batch", "size", o.cfg.BatchSize, "interval", o.cfg.BatchInterval)
+}
+
+// runBatchWriter accumulates readings and flushes them when either the batch
+// is full or the interval elapses. It returns after batchQueue is closed and
+// the remaining readings are flushed.
+func (o *Orchestrator) runBatchWriter(batchSize int, batchInterval time.Duration) {
+	defer close(o.batchDone)
+
+	batch := make([]SensorData, 0, batchSize)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-o.batchQueue:
+			if !ok {
+				o.flushBatch(batch)
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				o.flushBatch(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			o.flushBatch(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flushBatch inserts the batch, one InsertMany per target collection.
+func (o *Orchestrator) flushBatch(batch []SensorData) {
+	if len(batch) == 0 {
+		return
+	}
+	for _, group := range groupByCollection(batch) {
+		o.flushCollection(group[0].Collection, group)
+	}
+}
+
+// groupByCollection splits batch by target collection, keeping the order of
+// readings within each group. Several settings besides the topic routes set
+// a reading's collection, so it always groups.
+func groupByCollection(batch []SensorData) [][]SensorData {
+	index := make(map[string]int)
+	var groups [][]SensorData
+	for _, data := range batch {
+		i, ok := index[data.Collection]
+		if !ok {
+			i = len(groups)
+			index[data.Collection] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], data)
+	}
+	return groups
+}
+
+// flushCollection inserts readings bound for the same collection. Transient
+// failures are retried up to INSERT_RETRIES times; documents the database
+// rejects outright (duplicate key, validation) go straight to the DLQ.
+func (o *Orchestrator) flushCollection(collection string, batch []SensorData) {
+	links := make([]trace.Link, len(batch))
+	for i := range batch {
+		if batch[i].ID.IsZero() {
+			batch[i].ID = primitive.NewObjectID()
+		}
+		links[i] = trace.Link{SpanContext: batch[i].spanCtx}
+	}
+
+	// The batch mixes readings from many messages, so its span links to
+	// each of them rather than having a single parent.
+	_, span := tracer.Start(context.Background(), o.cfg.StorageBackend+" insert", trace.WithLinks(links...), trace.WithAttributes(
+		attribute.String("db.collection", o.collectionName(collection)),
+		attribute.Int("documents", len(batch)),
+	))
+	start := time.Now()
+
+	var stored []SensorData
+	failed := 0
+	// failure is the error of the last reading that failed, if any.
+	var failure error
+	pending := batch
+	delay := o.cfg.InsertRetryDelay
+	var err error
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			slog.Warn("Retrying insert", "component", "mongodb", "documents", len(pending), "attempt", attempt, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-o.workCtx.Done():
+			}
+			if err = o.workCtx.Err(); err != nil {
+				// The shutdown timed out, so keep the rest rather than
+				// waiting for retries that cannot succeed.
+				o.insertFailed(pending, newProcessError(stageInsert, err), start)
+				failed += len(pending)
+				failure = err
+				break
+			}
+			delay *= 2
+		}
+		canRetry := attempt < o.cfg.InsertRetries
+		err = o.insertBatch(pending)
+		if err == nil {
+			stored = append(stored, pending...)
+			break
+		}
+
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) {
+			if canRetry && isTransientMongoError(err) {
+				if mongo.IsNetworkError(err) {
+					o.ensureMongoConnected()
+				}
+				continue
+			}
+			o.insertFailed(pending, newProcessError(stageInsert, err), start)
+			failed += len(pending)
+			failure = err
+			break
+		}
+
+		rejected := make(map[int]bool, len(bwe.WriteErrors))
+		var retry []SensorData
+		for _, we := range bwe.WriteErrors {
+			data := pending[we.Index]
+			rejected[we.Index] = true
+			switch {
+			case isDuplicateIDError(we):
+				// An earlier attempt stored it before failing.
+				stored = append(stored, data)
+			case isTransientMongoError(we) && canRetry:
+				retry = append(retry, data)
+			case isTransientMongoError(we):
+				failed++
+				failure = errors.New(we.Message)
+				slog.Error("Insert failed", "component", "mongodb", "device_id", data.DeviceID, "message_id", data.MessageID, "timestamp", data.Timestamp, "error", we.Message)
+				o.deadLetterWriteError(data, stageInsert, we)
+			default:
+				failed++
+				failure = errors.New(we.Message)
+				slog.Error("Insert rejected", "component", "mongodb", "device_id", data.DeviceID, "message_id", data.MessageID, "timestamp", data.Timestamp, "code", we.Code, "error", we.Message)
+				o.deadLetterWriteError(data, stageRejected, we)
+			}
+		}
+		for i, data := range pending {
+			if !rejected[i] {
+				stored = append(stored, data)
+			}
+		}
+		reportWriteConcernError(err, len(pending)-len(bwe.WriteErrors))
+		pending = retry
+	}
+
+	latency := time.Since(start)
+	if failed == 0 {
+		err = nil
+	}
+	endSpan(span, err)
+	mongoInsertLatency.Observe(latency.Seconds())
+	mongoInserts.Add(float64(len(stored)))
+	mongoInsertFailures.Add(float64(failed))
+	if failure != nil {
+		o.diag.insertFailed(time.Now(), failure)
+	}
+	if len(stored) == 0 {
+		return
+	}
+	o.diag.insertSucceeded(time.Now())
+	o.storeLatest(stored)
+	acknowledgeAll(stored)
+	o.publishAcks(stored)
+	slog.Info("Stored batch", "component", "mongodb", "stored", len(stored), "documents", len(batch), "latency_ms", latency.Milliseconds())
+}
+
+// insertFailed hands a batch that could not be inserted at all to the disk
+// buffer, or to the DLQ without one.
+func (o *Orchestrator) insertFailed(batch []SensorData, failure *ProcessError, start time.Time) {
+	slog.Error("Batch insert failed", "component", "mongodb", "documents", len(batch), "latency_ms", time.Since(start).Milliseconds(), "code", failure.Code, "error", failure.Err)
+	failure.record(len(batch))
+	if o.diskBuf != nil {
+		o.diskBuf.append(batch)
+		return
+	}
+	for _, data := range batch {
+		o.writeDeadLetter(data, failure)
+	}
+}
+
+// deadLetterWriteError records a reading the database failed to insert as a
+// dead letter of stage.
+func (o *Orchestrator) deadLetterWriteError(data SensorData, stage string, we mongo.BulkWriteError) {
+	failure := &ProcessError{Stage: stage, Code: errorCode(we), Err: errors.New(we.Message)}
+	failure.record(1)
+	o.writeDeadLetter(data, failure)
+}
+
+// collectionName resolves "" to MONGO_COLLECTION.
+func (o *Orchestrator) collectionName(name string) string {
+	if name == "" {
+		return o.cfg.MongoCollection
+	}
+	return name
+}
+
+// insertBatch writes readings bound for the same collection to the store.
+func (o *Orchestrator) insertBatch(batch []SensorData) error {
+	ctx, cancel := context.WithTimeout(o.workCtx, o.cfg.MongoInsertTimeout)
+	defer cancel()
+	return o.store.InsertMany(ctx, batch)
+}
@@ -0,0 +1,118 @@
+// breaker.go
+package orchestrator
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling the cipher API while the
+// breaker is open.
+var errCircuitOpen = errors.New("cipher API circuit breaker is open")
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half-open"}
+
+// circuitBreaker trips after threshold consecutive failures and fails fast
+// for cooldown. It then lets one call through (half-open): success closes it
+// again, failure reopens it. A zero threshold disables it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open trial call is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may be made now.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (b *circuitBreaker) record(failed bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// abandon releases an allowed call that was cancelled on our side, without
+// counting it either way.
+func (b *circuitBreaker) abandon() {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// stateName returns "closed", "open" or "half-open".
+func (b *circuitBreaker) stateName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStateNames[b.state]
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	cipherBreakerState.Set(float64(state))
+	attrs := []any{"component", "cipher", "state", breakerStateNames[state]}
+	if state == breakerOpen {
+		slog.Warn("Circuit breaker opened", append(attrs, "failures", b.failures, "cooldown", b.cooldown)...)
+		return
+	}
+	slog.Info("Circuit breaker state changed", attrs...)
+}
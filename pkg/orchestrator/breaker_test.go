@@ -0,0 +1,84 @@
+// breaker_test.go
+package orchestrator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Each step either records the outcome of a call, lets the cooldown
+	// pass, or checks allow and the resulting state.
+	type step struct {
+		record, failed bool
+		cooldownPassed bool
+		allow          bool
+		state          string
+	}
+	fail := step{record: true, failed: true}
+	succeed := step{record: true}
+	elapse := step{cooldownPassed: true}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "closed below threshold",
+			threshold: 3,
+			steps:     []step{fail, fail, {allow: true, state: "closed"}},
+		},
+		{
+			name:      "success resets failures",
+			threshold: 2,
+			steps:     []step{fail, succeed, fail, {allow: true, state: "closed"}},
+		},
+		{
+			name:      "opens at threshold",
+			threshold: 2,
+			steps:     []step{fail, fail, {allow: false, state: "open"}},
+		},
+		{
+			name:      "one trial call when half-open",
+			threshold: 1,
+			steps:     []step{fail, elapse, {allow: true, state: "half-open"}, {allow: false, state: "half-open"}},
+		},
+		{
+			name:      "trial success closes",
+			threshold: 1,
+			steps:     []step{fail, elapse, {allow: true, state: "half-open"}, succeed, {allow: true, state: "closed"}},
+		},
+		{
+			name:      "trial failure reopens",
+			threshold: 3,
+			steps:     []step{fail, fail, fail, elapse, {allow: true, state: "half-open"}, fail, {allow: false, state: "open"}},
+		},
+		{
+			name:      "disabled",
+			threshold: 0,
+			steps:     []step{fail, fail, fail, {allow: true, state: "closed"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(tt.threshold, time.Hour)
+			for i, s := range tt.steps {
+				switch {
+				case s.record:
+					b.record(s.failed)
+				case s.cooldownPassed:
+					b.mu.Lock()
+					b.openedAt = b.openedAt.Add(-b.cooldown)
+					b.mu.Unlock()
+				default:
+					if got := b.allow(); got != s.allow {
+						t.Errorf("step %d: allow() = %v, want %v", i, got, s.allow)
+					}
+					if got := b.stateName(); got != s.state {
+						t.Errorf("step %d: state = %s, want %s", i, got, s.state)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// buffer.go
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// diskBuffer is an append-only file of JSON-encoded readings that could not
+// be inserted while MongoDB was unreachable. It holds at most max records;
+// when full, the oldest tenth is dropped to make room.
+type diskBuffer struct {
+	mu    sync.Mutex
+	path  string
+	max   int
+	count int
+}
+
+func (o *Orchestrator) openDiskBuffer() error {
+	if o.cfg.BufferPath == "" {
+		return nil
+	}
+
+	b := &diskBuffer{path: o.cfg.BufferPath, max: o.cfg.BufferMaxRecords}
+
+	// A replay file left behind by a crash still holds unreplayed readings.
+	if leftover, err := readRecords(b.replayPath()); err == nil {
+		b.append(leftover)
+		os.Remove(b.replayPath())
+	}
+
+	records, err := readRecords(b.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("open buffer: %w", err)
+	}
+	b.count = len(records)
+
+	o.diskBuf = b
+	slog.Info("Buffering readings on disk during outages", "component", "buffer", "path", b.path, "buffered", b.count)
+	return nil
+}
+
+// buffered returns the number of readings in the buffer.
+func (b *diskBuffer) buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+func (b *diskBuffer) replayPath() string {
+	return b.path + ".replay"
+}
+
+// append writes records to the end of the buffer, dropping the oldest ones
+// when the buffer is full. The messages of all records are acknowledged,
+// including those that could not be written.
+func (b *diskBuffer) append(records []SensorData) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count+len(records) > b.max {
+		b.compact(len(records))
+	}
+
+	f, err := os.OpenFile(b.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.Error("Failed to open buffer", "component", "buffer", "path", b.path, "error", err)
+		failAll(records, err)
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	var written []SensorData
+	for _, data := range records {
+		if err := enc.Encode(data); err != nil {
+			slog.Error("Failed to buffer reading", "component", "buffer", "device_id", data.DeviceID, "message_id", data.MessageID, "error", err)
+			data.fail(err)
+			data.acknowledge()
+			continue
+		}
+		b.count++
+		written = append(written, data)
+	}
+	if err := w.Flush(); err != nil {
+		slog.Error("Failed to write buffer", "component", "buffer", "path", b.path, "error", err)
+		failAll(records, err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		slog.Error("Failed to write buffer", "component", "buffer", "path", b.path, "error", err)
+		failAll(records, err)
+		return
+	}
+	acknowledgeAll(written)
+	slog.Warn("Buffered readings on disk", "component", "buffer", "records", len(records), "buffered", b.count)
+}
+
+// compact drops the oldest records so that incoming more fit. It must be
+// called with b.mu held.
+func (b *diskBuffer) compact(incoming int) {
+	records, err := readRecords(b.path)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to read buffer", "component", "buffer", "path", b.path, "error", err)
+		return
+	}
+
+	keep := b.max - b.max/10 - incoming
+	if keep < 0 {
+		keep = 0
+	}
+	if len(records) <= keep {
+		return
+	}
+	dropped := len(records) - keep
+	records = records[dropped:]
+
+	tmp := b.path + ".tmp"
+	if err := writeRecords(tmp, records); err != nil {
+		slog.Error("Failed to compact buffer", "component", "buffer", "path", b.path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		slog.Error("Failed to compact buffer", "component", "buffer", "path", b.path, "error", err)
+		return
+	}
+	b.count = len(records)
+	slog.Warn("Buffer full, dropped oldest readings", "component", "buffer", "dropped", dropped)
+}
+
+// take moves the buffered records aside for replay and returns them, so new
+// failures can keep appending while the replay runs.
+func (b *diskBuffer) take() ([]SensorData, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.count == 0 {
+		return nil, nil
+	}
+	if err := os.Rename(b.path, b.replayPath()); err != nil {
+		return nil, err
+	}
+	b.count = 0
+	return readRecords(b.replayPath())
+}
+
+// startBufferReplay periodically replays the buffer into MongoDB once it is
+// reachable again, until ctx is done.
+func (o *Orchestrator) startBufferReplay(ctx context.Context) {
+	if o.diskBuf == nil || o.cfg.DryRun {
+		close(o.bufferDone)
+		return
+	}
+
+	go func() {
+		defer close(o.bufferDone)
+
+		ticker := time.NewTicker(o.cfg.BufferReplayInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				o.replayDiskBuffer()
+			}
+		}
+	}()
+}
+
+// replayDiskBuffer inserts the buffered readings once the store answers again.
+func (o *Orchestrator) replayDiskBuffer() {
+	b := o.diskBuf
+	b.mu.Lock()
+	empty := b.count == 0
+	b.mu.Unlock()
+
+	if empty || o.ensureStoreAvailable() != nil {
+		return
+	}
+
+	records, err := b.take()
+	if err != nil {
+		slog.Error("Failed to read buffer for replay", "component", "buffer", "error", err)
+		return
+	}
+
+	replayed := 0
+	var keep []SensorData
+	for start := 0; start < len(records); start += o.cfg.BatchSize {
+		end := start + o.cfg.BatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		chunk := records[start:end]
+
+		stored, failed, err := o.replayGroups(chunk)
+		if len(stored) > 0 {
+			o.storeLatest(stored)
+			o.publishAcks(stored)
+			mongoInserts.Add(float64(len(stored)))
+			o.diag.insertSucceeded(time.Now())
+			replayed += len(stored)
+		}
+		keep = append(keep, failed...)
+		if err != nil {
+			slog.Error("Replay failed, keeping remaining readings", "component", "buffer", "remaining", len(failed)+len(records)-end, "error", err)
+			newProcessError(stageInsert, err).record(len(failed))
+			o.diag.insertFailed(time.Now(), err)
+			keep = append(keep, records[end:]...)
+			break
+		}
+	}
+	if len(keep) > 0 {
+		b.append(keep)
+	}
+
+	os.Remove(b.replayPath())
+	slog.Info("Replayed buffered readings", "component", "buffer", "replayed", replayed, "total", len(records))
+}
+
+// replayGroups inserts buffered records into their target collections and
+// splits write errors like flushCollection: records MongoDB rejects go to the
+// DLQ, and those a transient write error failed are returned to be kept
+// buffered. Records stored by an earlier, interrupted attempt count as
+// stored. An insert that fails as a whole stops the replay; its error is
+// returned, with its records and those of the groups after it.
+func (o *Orchestrator) replayGroups(records []SensorData) (stored, failed []SensorData, err error) {
+	groups := groupByCollection(records)
+	for i, group := range groups {
+		insertErr := o.insertBatch(group)
+		var bwe mongo.BulkWriteException
+		switch {
+		case insertErr == nil || storedDespite(insertErr):
+			reportWriteConcernError(insertErr, len(group))
+			stored = append(stored, group...)
+		case errors.As(insertErr, &bwe):
+			rejected := make(map[int]bool, len(bwe.WriteErrors))
+			for _, we := range bwe.WriteErrors {
+				data := group[we.Index]
+				rejected[we.Index] = true
+				switch {
+				case isDuplicateIDError(we):
+					stored = append(stored, data)
+				case isTransientMongoError(we):
+					slog.Warn("Replay failed, keeping reading", "component", "buffer", "device_id", data.DeviceID, "message_id", data.MessageID, "error", we.Message)
+					(&ProcessError{Stage: stageInsert, Code: errorCode(we), Err: errors.New(we.Message)}).record(1)
+					failed = append(failed, data)
+				default:
+					slog.Error("Insert rejected", "component", "buffer", "device_id", data.DeviceID, "message_id", data.MessageID, "timestamp", data.Timestamp, "code", we.Code, "error", we.Message)
+					o.deadLetterWriteError(data, stageRejected, we)
+				}
+			}
+			for j, data := range group {
+				if !rejected[j] {
+					stored = append(stored, data)
+				}
+			}
+			reportWriteConcernError(insertErr, len(group)-len(bwe.WriteErrors))
+		default:
+			for _, rest := range groups[i:] {
+				failed = append(failed, rest...)
+			}
+			return stored, failed, insertErr
+		}
+	}
+	return stored, failed, nil
+}
+
+func readRecords(path string) ([]SensorData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []SensorData
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var data SensorData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			slog.Warn("Skipping corrupt buffer record", "component", "buffer", "path", path, "error", err)
+			continue
+		}
+		records = append(records, data)
+	}
+	return records, scanner.Err()
+}
+
+func writeRecords(path string, records []SensorData) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, data := range records {
+		if err := enc.Encode(data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
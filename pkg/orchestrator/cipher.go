@@ -0,0 +1,413 @@
+// cipher.go
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func (o *Orchestrator) initCipherClient() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = o.cfg.EncryptMaxIdleConns
+	transport.MaxIdleConnsPerHost = o.cfg.EncryptMaxIdleConns
+	transport.IdleConnTimeout = 90 * time.Second
+	o.cipherClient = &http.Client{Timeout: o.cfg.EncryptTimeout, Transport: transport}
+}
+
+// cipherStatusError reports a non-200 response from the cipher API.
+type cipherStatusError struct {
+	StatusCode int
+}
+
+func (e *cipherStatusError) Error() string {
+	return fmt.Sprintf("non-200 response: %d", e.StatusCode)
+}
+
+// errInvalidCipherResponse marks 200 responses that cannot be used: a body
+// that does not decode, or a missing ciphertext. Storing those would silently
+// replace readings with empty payloads, so they fail like any other error.
+var errInvalidCipherResponse = errors.New("invalid cipher API response")
+
+// CipherEnvelope is what an envelope-encrypting cipher API returns next to
+// a ciphertext and needs back to decrypt it, read from the response fields
+// named by ENCRYPT_KEY_ID_FIELD and ENCRYPT_IV_FIELD.
+type CipherEnvelope struct {
+	KeyID string `json:"key_id,omitempty" bson:"key_id,omitempty"`
+	IV    string `json:"iv,omitempty" bson:"iv,omitempty"`
+}
+
+func (e CipherEnvelope) isZero() bool {
+	return e == CipherEnvelope{}
+}
+
+// cipherResult is the text a cipher API call returned, with its envelope.
+type cipherResult struct {
+	Text     string
+	Envelope CipherEnvelope
+}
+
+// encryptWithRetry encrypts text, retrying transient failures with
+// exponential backoff until ctx is done.
+func (o *Orchestrator) encryptWithRetry(ctx context.Context, text string) (cipherResult, error) {
+	var result cipherResult
+	err := o.withCipherRetry(ctx, func() (err error) {
+		result, err = o.callCipher(ctx, o.cfg.EncryptPath, text, CipherEnvelope{})
+		if err == nil && result.Text == "" {
+			err = fmt.Errorf("%w: empty result", errInvalidCipherResponse)
+		}
+		return err
+	})
+	return result, err
+}
+
+// encryptBatchWithRetry encrypts texts with a single encrypt-batch call,
+// retrying like encryptWithRetry.
+func (o *Orchestrator) encryptBatchWithRetry(ctx context.Context, texts []string) ([]cipherResult, error) {
+	var results []cipherResult
+	err := o.withCipherRetry(ctx, func() (err error) {
+		results, err = o.callCipherBatch(ctx, "encrypt-batch", texts)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Text == "" {
+				return fmt.Errorf("%w: empty result at index %d", errInvalidCipherResponse, i)
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// withCipherRetry runs call until it succeeds, retrying transient failures up
+// to ENCRYPT_RETRIES times with exponential backoff. Client errors (4xx) are
+// not retried, and neither is anything once ctx is done.
+func (o *Orchestrator) withCipherRetry(ctx context.Context, call func() error) error {
+	delay := o.cfg.EncryptRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil {
+			cipherRequests.WithLabelValues("success").Inc()
+			return nil
+		}
+		cipherRequests.WithLabelValues("failure").Inc()
+		if errors.Is(err, errInvalidCipherResponse) {
+			cipherInvalidResponses.Inc()
+			slog.Warn("Cipher API returned an unusable response", "component", "cipher", "error", err)
+		}
+
+		var statusErr *cipherStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+			return err
+		}
+		if errors.Is(err, errCircuitOpen) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= o.cfg.EncryptRetries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+
+		slog.Warn("Encrypt failed, retrying", "component", "cipher", "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// cipherRequest is the body sent to the cipher API. Marshalling it (rather
+// than formatting a string) escapes quotes, backslashes and control
+// characters in the payload.
+type cipherRequest struct {
+	Text string `json:"text"`
+}
+
+// cipherBatchRequest is the body sent to the encrypt-batch endpoint.
+type cipherBatchRequest struct {
+	Texts []string `json:"texts"`
+}
+
+// callCipher posts text to the given cipher API path (e.g. "decrypt")
+// and returns the "result" field of the response with its envelope, if any.
+// A non-empty env is sent along, under the same field names, for decryption.
+func (o *Orchestrator) callCipher(ctx context.Context, endpoint, text string, env CipherEnvelope) (cipherResult, error) {
+	var body interface{} = cipherRequest{Text: text}
+	if !env.isZero() {
+		fields := map[string]string{"text": text}
+		if o.cfg.EncryptKeyIDField != "" && env.KeyID != "" {
+			fields[o.cfg.EncryptKeyIDField] = env.KeyID
+		}
+		if o.cfg.EncryptIVField != "" && env.IV != "" {
+			fields[o.cfg.EncryptIVField] = env.IV
+		}
+		body = fields
+	}
+	var result map[string]json.RawMessage
+	if err := o.postCipher(ctx, endpoint, body, &result); err != nil {
+		return cipherResult{}, err
+	}
+	return o.parseCiphertext(result, "result")
+}
+
+// callCipherBatch posts texts to a batch endpoint and returns the "results"
+// array, which must hold one entry per text in the same order. An entry is
+// either the ciphertext or an object with it under "result" and its
+// envelope.
+func (o *Orchestrator) callCipherBatch(ctx context.Context, endpoint string, texts []string) ([]cipherResult, error) {
+	var result struct {
+		Results []json.RawMessage `json:"results"`
+	}
+	if err := o.postCipher(ctx, endpoint, cipherBatchRequest{Texts: texts}, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(texts) {
+		return nil, fmt.Errorf("%w: got %d results for %d texts", errInvalidCipherResponse, len(result.Results), len(texts))
+	}
+	results := make([]cipherResult, len(texts))
+	for i, raw := range result.Results {
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			results[i] = cipherResult{Text: text}
+			continue
+		}
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("%w: result at index %d is neither a string nor an object", errInvalidCipherResponse, i)
+		}
+		r, err := o.parseCiphertext(entry, "result")
+		if err != nil {
+			return nil, fmt.Errorf("result at index %d: %w", i, err)
+		}
+		results[i] = r
+	}
+	return results, nil
+}
+
+// parseCiphertext reads the text under field and the envelope fields from a
+// cipher API response object. Missing fields are left empty.
+func (o *Orchestrator) parseCiphertext(obj map[string]json.RawMessage, field string) (cipherResult, error) {
+	var result cipherResult
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{field, &result.Text},
+		{o.cfg.EncryptKeyIDField, &result.Envelope.KeyID},
+		{o.cfg.EncryptIVField, &result.Envelope.IV},
+	} {
+		raw, ok := obj[f.name]
+		if f.name == "" || !ok || string(raw) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(raw, f.dst); err != nil {
+			return cipherResult{}, fmt.Errorf("%w: %q is not a string", errInvalidCipherResponse, f.name)
+		}
+	}
+	return result, nil
+}
+
+// postCipher sends body as JSON to the cipher API endpoint and decodes the
+// response into result. It fails fast while the circuit breaker is open.
+func (o *Orchestrator) postCipher(ctx context.Context, endpoint string, body, result interface{}) error {
+	if !o.cipherBreaker.allow() {
+		return errCircuitOpen
+	}
+	err := o.doPostCipher(ctx, endpoint, body, result)
+	if ctx.Err() != nil {
+		// Our deadline, not the API, ended the call.
+		o.cipherBreaker.abandon()
+		return err
+	}
+	if err != nil {
+		o.diag.cipherFailed(time.Now(), err)
+	}
+
+	// Client errors mean the API is up; only transport failures and 5xx
+	// responses count towards tripping the breaker.
+	var statusErr *cipherStatusError
+	o.cipherBreaker.record(err != nil && !(errors.As(err, &statusErr) && statusErr.StatusCode < 500))
+	return err
+}
+
+func (o *Orchestrator) doPostCipher(ctx context.Context, endpoint string, body, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	// JoinPath adds exactly one slash between the base URL and the endpoint,
+	// whether or not ENCRYPT_API_URL ends with one.
+	target := o.cfg.EncryptAPIURL.JoinPath(endpoint).String()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("request creation failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.cfg.EncryptAPIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+o.cfg.EncryptAPIToken)
+	}
+	if o.cfg.EncryptAPIKey != "" {
+		req.Header.Set(o.cfg.EncryptAPIKeyHeader, o.cfg.EncryptAPIKey)
+	}
+
+	resp, err := o.cipherClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return &cipherStatusError{StatusCode: resp.StatusCode}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%w: decode failed: %v", errInvalidCipherResponse, err)
+	}
+	// Drain what is left so the connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// startEncryptStage starts the encrypt batcher with ENCRYPT_BATCH_SIZE > 1,
+// or ENCRYPT_CONCURRENCY encrypt workers otherwise. Without either, Store
+// encrypts inline.
+func (o *Orchestrator) startEncryptStage() {
+	if !o.cfg.Encryption {
+		return
+	}
+	if o.cfg.EncryptBatchSize > 1 {
+		o.encryptQueue = make(chan SensorData, o.cfg.EncryptBatchSize)
+		o.queueReaders.Add(1)
+		go o.runEncryptBatcher(o.cfg.EncryptBatchSize, o.cfg.EncryptBatchInterval, max(o.cfg.EncryptConcurrency, 1))
+		slog.Info("Batching encryption", "component", "cipher", "size", o.cfg.EncryptBatchSize, "interval", o.cfg.EncryptBatchInterval, "concurrency", max(o.cfg.EncryptConcurrency, 1))
+		return
+	}
+	if o.cfg.EncryptConcurrency == 0 {
+		return
+	}
+	o.encryptQueue = make(chan SensorData, o.cfg.EncryptConcurrency)
+	o.queueReaders.Add(o.cfg.EncryptConcurrency)
+	for i := 0; i < o.cfg.EncryptConcurrency; i++ {
+		go func() {
+			defer o.queueReaders.Done()
+			for data := range o.encryptQueue {
+				o.encryptQueued(data)
+				o.inflight.Done()
+			}
+		}()
+	}
+	slog.Info("Encrypt workers started", "component", "cipher", "concurrency", o.cfg.EncryptConcurrency)
+}
+
+// encryptQueued encrypts and stores a reading taken from encryptQueue by an
+// encrypt worker. Like a batch, it runs under the work context rather than
+// the deadline of the message, which has been handled by now.
+func (o *Orchestrator) encryptQueued(data SensorData) {
+	ctx, span := tracer.Start(o.workCtx, "encrypt", trace.WithLinks(trace.Link{SpanContext: data.spanCtx}))
+	sealed, err := o.encryptReading(ctx, data)
+	endSpan(span, err)
+	if data, ok := o.applyEncryption(sealed, err); ok {
+		o.persist(o.workCtx, data)
+	}
+}
+
+// runEncryptBatcher encrypts queued readings once the batch is full or the
+// interval elapses, with up to concurrency batches in flight. Each queued
+// reading holds an inflight slot, released once it has been handed on. It
+// returns once encryptQueue is closed and its batches are done.
+func (o *Orchestrator) runEncryptBatcher(batchSize int, batchInterval time.Duration, concurrency int) {
+	defer o.queueReaders.Done()
+	batch := make([]SensorData, 0, batchSize)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	slots := make(chan struct{}, concurrency)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Waiting for a slot stops the batcher, so a full queue holds
+		// back Store.
+		slots <- struct{}{}
+		go func(batch []SensorData) {
+			defer func() { <-slots }()
+			o.encryptBatch(batch)
+		}(slices.Clone(batch))
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case data, ok := <-o.encryptQueue:
+			if !ok {
+				flush()
+				for range concurrency {
+					slots <- struct{}{}
+				}
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// encryptBatch encrypts the texts of every reading in the batch with one
+// encrypt-batch call and stores the readings.
+func (o *Orchestrator) encryptBatch(batch []SensorData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	jobs := make([]cipherJob, len(batch))
+	var texts []string
+	links := make([]trace.Link, len(batch))
+	for i, data := range batch {
+		jobs[i] = o.newCipherJob(data)
+		texts = append(texts, jobs[i].texts...)
+		links[i] = trace.Link{SpanContext: data.spanCtx}
+	}
+	var ciphertexts []cipherResult
+	var err error
+	if len(texts) > 0 {
+		// The batch mixes readings from many messages, so it runs under the
+		// work context rather than any one message's deadline.
+		ctx, span := tracer.Start(o.workCtx, "encrypt batch", trace.WithLinks(links...))
+		ciphertexts, err = o.encryptBatchWithRetry(ctx, texts)
+		endSpan(span, err)
+	}
+
+	offset := 0
+	for i, data := range batch {
+		n := len(jobs[i].texts)
+		dataErr := err
+		switch {
+		case n == 0:
+			dataErr = nil
+		case err == nil:
+			data = o.seal(data, jobs[i], ciphertexts[offset:offset+n])
+		}
+		offset += n
+		if data, ok := o.applyEncryption(data, dataErr); ok {
+			o.persist(o.workCtx, data)
+		}
+		o.inflight.Done()
+	}
+}
@@ -0,0 +1,1065 @@
+// config.go
+package orchestrator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// Config holds every setting of the orchestrator. It is read from the
+// environment, and the optional CONFIG_FILE, at startup by LoadConfig and
+// again on POST /admin/reload. Programs embedding the orchestrator should
+// start from LoadConfig and adjust fields, since it fills in the defaults and
+// the parsed forms of the variables.
+type Config struct {
+	// StorageBackend is "mongo" or "file". The file backend writes JSON lines
+	// to StorageFile, "-" being stdout.
+	StorageBackend string
+	StorageFile    string
+	// KafkaEnable mirrors every stored reading as JSON to KafkaTopic on
+	// KafkaBrokers, in addition to StorageBackend.
+	KafkaEnable  bool
+	KafkaBrokers []string
+	KafkaTopic   string
+
+	// MongoURI, when set, is used as is instead of the MONGO_USER, MONGO_PASS,
+	// MONGO_HOST and MONGO_PORT settings.
+	MongoURI        string
+	MongoUser       string
+	MongoPass       string
+	MongoHost       string
+	MongoPort       string
+	MongoDatabase   string
+	MongoCollection string
+	// CollectionRoutes send readings from some topics to other collections
+	// than MongoCollection.
+	CollectionRoutes []collectionRoute
+	LatestCollection string
+	DLQCollection    string
+	// RouteByField, when set, sends readings whose JSON payload has that
+	// string field to RouteCollectionPrefix plus its value, if the value is
+	// in RouteAllowedValues (or, when that is empty, looks safe).
+	RouteByField          string
+	RouteCollectionPrefix string
+	RouteAllowedValues    []string
+	// OfflineTimeout, when non-zero, tracks device presence in
+	// PresenceCollection and under PresenceTopicPrefix.
+	OfflineTimeout      time.Duration
+	PresenceCollection  string
+	PresenceTopicPrefix string
+	// RollupInterval, when non-zero, writes per-device min/max/avg of
+	// numeric payload fields per interval to RollupCollection.
+	RollupInterval   time.Duration
+	RollupCollection string
+	MongoRetryBase   time.Duration
+	MongoRetryMax    time.Duration
+	// MongoConnectTimeout bounds each connection attempt, including the
+	// initial ping; MongoInsertTimeout bounds every write.
+	MongoConnectTimeout time.Duration
+	MongoInsertTimeout  time.Duration
+	// InsertRetries bounds immediate retries of transient insert failures,
+	// starting InsertRetryDelay apart and doubling.
+	InsertRetries     int
+	InsertRetryDelay  time.Duration
+	MongoMaxPool      uint64
+	MongoMinPool      uint64
+	MongoWriteConcern *writeconcern.WriteConcern
+	// MongoVersionCheck is "warn", "fail" or "off": what to do when the
+	// server is too old for a setting in use.
+	MongoVersionCheck string
+	DLQRetryInterval  time.Duration
+	// DLQMaxRetries, when non-zero, moves dead letters that failed that many
+	// retries to QuarantineCollection, where they are never retried.
+	DLQMaxRetries        int
+	QuarantineCollection string
+	CreateIndexes        bool
+	// DataRetention, when non-zero, expires readings via a TTL index.
+	DataRetention time.Duration
+	// TimeSeries creates missing data collections as time-series
+	// collections with TimeSeriesGranularity.
+	TimeSeries            bool
+	TimeSeriesGranularity string
+
+	// MQTTBrokers lists the brokers as host:port, in failover order.
+	MQTTBrokers []string
+	MQTTVersion int
+	// MQTTClientID defaults to "mqtt-orchestrator-" plus the host name, so
+	// replicas do not take over each other's connection.
+	MQTTClientID string
+	// MQTTStoreDir, when set, keeps in-flight QoS 1/2 state on disk and the
+	// broker session across restarts.
+	MQTTStoreDir string
+	// MQTTPersistentSession asks the broker to keep the session, with its
+	// subscriptions and queued messages, across disconnects. It defaults to
+	// true with MQTTStoreDir or a QoS 1/2 subscription, and MQTT_CLEAN_SESSION
+	// overrides it. MQTTSessionExpiry is how long an MQTT v5 broker keeps the
+	// session once disconnected.
+	MQTTPersistentSession bool
+	MQTTSessionExpiry     time.Duration
+	// MQTTSharedGroup, when set, subscribes through the shared subscription
+	// $share/{group}/, so replicas in the group split the messages.
+	MQTTSharedGroup string
+	// ManualAck acknowledges QoS 1/2 messages only once their reading is
+	// stored, buffered or dead-lettered.
+	ManualAck bool
+	// MQTTConnectRetry is the first delay between connection attempts; it
+	// doubles up to MQTTMaxReconnect.
+	MQTTConnectRetry time.Duration
+	MQTTMaxReconnect time.Duration
+	MQTTUsername     string
+	MQTTPassword     string
+	Subscriptions    []subscription
+	// MQTTTransport is "tcp", "ws" or "wss"; WebSocket connections go to
+	// MQTTWSPath on each broker. "wss" turns on MQTTTLS.
+	MQTTTransport   string
+	MQTTWSPath      string
+	MQTTTLS         bool
+	MQTTCACert      string
+	MQTTClientCert  string
+	MQTTClientKey   string
+	MQTTTLSInsecure bool
+	DeviceIDPattern *regexp.Regexp
+	DeviceIDIndex   *int
+
+	// LWTTopic receives LWTPayload from the broker if the orchestrator
+	// disconnects uncleanly, and OnlinePayload whenever it connects.
+	LWTTopic      string
+	LWTPayload    string
+	OnlinePayload string
+	LWTQoS        byte
+	LWTRetained   bool
+
+	// Decompress is "none", "gzip" (always) or "auto" (detected).
+	Decompress string
+	// PayloadEncoding is "text", "base64" (always) or "auto". Payloads that
+	// are not valid UTF-8 are base64-encoded either way; "text" also logs a
+	// warning for them.
+	PayloadEncoding string
+	// PayloadCharset, when set, is the charset payloads are transcoded from
+	// to UTF-8 on receipt.
+	PayloadCharset encoding.Encoding
+	// AckTopicPrefix, when set, receives an ack under {prefix}/{device_id}
+	// for every stored reading.
+	AckTopicPrefix string
+	AckQoS         byte
+	// StatsTopic, when set, receives ingestion counters every StatsInterval.
+	StatsTopic       string
+	StatsInterval    time.Duration
+	ParseJSONPayload bool
+	// FlattenPayload stores payload_json with nested objects flattened into
+	// top-level fields named by joining their path with FlattenSeparator.
+	FlattenPayload   bool
+	FlattenSeparator string
+	// StoreMQTTMeta stores the retained, QoS, duplicate and packet ID of
+	// each message.
+	StoreMQTTMeta bool
+	// RetainedAction decides what happens to retained messages the broker
+	// replays on subscribe: "store" handles them like any other, "skip"
+	// drops them and "flag" stores them marked as retained.
+	RetainedAction string
+	// FormatRoutes declare the payload format of some topics.
+	FormatRoutes []formatRoute
+	// CSVHeaders, when set, names the fields of csv payloads, which are then
+	// stored as a payload_json document of one row.
+	CSVHeaders []string
+	// TransformRules, when set, rewrite JSON object payloads before storage.
+	TransformRules *transformRules
+	// ExtractFields are payload fields copied to top-level document fields,
+	// after TransformRules.
+	ExtractFields []string
+	// TopicTemplate, when set, stores named topic levels as document fields.
+	TopicTemplate *topicTemplate
+
+	// Site, GatewayID and Environment are stored with every reading.
+	Site        string
+	GatewayID   string
+	Environment string
+	// SchemaPath is a JSON Schema that payloads must satisfy; invalid ones
+	// are dropped or sent to the DLQ according to SchemaInvalidAction.
+	SchemaPath          string
+	SchemaInvalidAction string
+	// MaxPayloadBytes rejects larger payloads; zero means no limit.
+	MaxPayloadBytes int
+	// TimestampField names the JSON payload field holding the device's own
+	// timestamp; readings without a usable one get the server time.
+	TimestampField string
+	// MaxMessageAge, when set, treats readings whose device timestamp is
+	// older than this as stale: StaleAction "drop" discards them, "flag"
+	// stores them marked as stale and "archive" stores them marked in
+	// StaleCollection.
+	MaxMessageAge   time.Duration
+	StaleAction     string
+	StaleCollection string
+	// TimestampPrecision is the unit reading timestamps are truncated to.
+	TimestampPrecision time.Duration
+	// TimestampFormat is "date" (BSON date) or "epoch_ms" (Unix
+	// milliseconds as an int64).
+	TimestampFormat string
+
+	// DedupWindow, when non-zero, skips readings identical to one seen from
+	// the same device within the window.
+	DedupWindow     time.Duration
+	DedupMaxEntries int
+	// SampleInterval, when non-zero, keeps one reading per device and topic
+	// per interval; SampleRoutes override it for some topics. SampleMode is
+	// "drop" or "average".
+	SampleInterval time.Duration
+	SampleRoutes   []sampleRoute
+	SampleMode     string
+
+	// RateLimit is the per-device limit in readings per second; zero
+	// disables it.
+	RateLimit float64
+	RateBurst int
+
+	Encryption bool
+	// EncryptAPIURL is the cipher API base URL; endpoint paths are joined to
+	// it.
+	EncryptAPIURL *url.URL
+	// EncryptPath is the encrypt endpoint, relative to EncryptAPIURL.
+	EncryptPath string
+	// EncryptTopics, when set, limits encryption to readings from topics
+	// matching one of these filters.
+	EncryptTopics []string
+	// EncryptFields, when set, encrypts only these fields of JSON object
+	// payloads instead of the whole payload.
+	EncryptFields []string
+	// EncryptKeyIDField and EncryptIVField name the envelope fields of
+	// cipher API responses; empty ignores them.
+	EncryptKeyIDField string
+	EncryptIVField    string
+	// EncryptAPIToken is sent as a bearer token, and EncryptAPIKey in the
+	// EncryptAPIKeyHeader header; either or both may be set.
+	EncryptAPIToken     string
+	EncryptAPIKeyHeader string
+	EncryptAPIKey       string
+	EncryptRetries      int
+	EncryptRetryDelay   time.Duration
+	EncryptTimeout      time.Duration
+	EncryptMaxIdleConns int
+	// EncryptBatchSize > 1 encrypts readings together via encrypt-batch.
+	EncryptBatchSize     int
+	EncryptBatchInterval time.Duration
+	// EncryptConcurrency > 0 moves encryption off the message handlers to
+	// that many concurrent cipher API calls (encrypt or encrypt-batch).
+	EncryptConcurrency int
+	// CipherBreakerThreshold consecutive failures open the breaker for
+	// CipherBreakerCooldown; zero disables it.
+	CipherBreakerThreshold int
+	CipherBreakerCooldown  time.Duration
+	// EncryptFallback decides what happens to a reading once all encryption
+	// attempts failed: "drop" discards it, "plaintext" stores it unencrypted
+	// and "dlq" sends it to the dead-letter collection.
+	EncryptFallback string
+
+	// Workers > 0 handles messages in a pool fed by a queue of
+	// WorkerQueueSize; QueueFullPolicy is "block" or "drop".
+	Workers         int
+	WorkerQueueSize int
+	QueueFullPolicy string
+	// MaxInflight > 0 caps the messages queued for or in HandleMessage;
+	// OverflowPolicy is "block" or "drop" for messages beyond it.
+	MaxInflight    int
+	OverflowPolicy string
+
+	BatchSize     int
+	BatchInterval time.Duration
+
+	BufferPath           string
+	BufferMaxRecords     int
+	BufferReplayInterval time.Duration
+
+	HealthPort  string
+	MetricsPort string
+	// APIPort, when set, serves the read-back API on it for requests
+	// bearing APIToken.
+	APIPort  string
+	APIToken string
+	// AdminToken, when set, enables POST /admin/reload on HealthPort for
+	// requests bearing it.
+	AdminToken string
+	// GRPCPort, when set, serves the gRPC ingestion endpoint on it.
+	GRPCPort string
+	// IngestPort, when set, serves POST /ingest on it for requests bearing
+	// IngestAPIKey.
+	IngestPort   string
+	IngestAPIKey string
+
+	LogLevel  slog.Level
+	LogFormat string
+
+	ShutdownTimeout time.Duration
+	// StartupJitter, when non-zero, is the longest Run waits, for a random
+	// time, before connecting to the storage backend and the broker.
+	StartupJitter time.Duration
+	// MessageTimeout, when non-zero, bounds the handling of each message,
+	// including encryption and waiting for the batch writer.
+	MessageTimeout time.Duration
+	// OTLPEndpoint enables tracing; the exporter reads it from the environment.
+	OTLPEndpoint string
+	// DryRun logs readings instead of writing them to MongoDB.
+	DryRun bool
+}
+
+// LoadConfig reads the configuration from the environment, applies defaults
+// and validates it. The returned error lists every missing or invalid
+// variable at once.
+func LoadConfig() (Config, error) {
+	env := &envReader{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("CONFIG_FILE: %v", err)
+		}
+		env.file = values
+	}
+	var c Config
+
+	c.StorageBackend = strings.ToLower(env.str("STORAGE_BACKEND", "mongo"))
+	c.StorageFile = env.str("STORAGE_FILE", "-")
+	mongoBackend := c.StorageBackend == "mongo"
+	if !mongoBackend && c.StorageBackend != "file" {
+		env.fail("STORAGE_BACKEND: %q must be mongo or file", c.StorageBackend)
+	}
+	c.KafkaEnable = env.boolean("KAFKA_ENABLE")
+	if c.KafkaEnable {
+		brokers := env.required("KAFKA_BROKERS")
+		for _, b := range strings.Split(brokers, ",") {
+			b = strings.TrimSpace(b)
+			if b == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(b); err != nil {
+				b = net.JoinHostPort(b, "9092")
+			}
+			c.KafkaBrokers = append(c.KafkaBrokers, b)
+		}
+		if len(c.KafkaBrokers) == 0 && brokers != "" {
+			env.fail("KAFKA_BROKERS: no brokers given")
+		}
+		c.KafkaTopic = env.str("KAFKA_TOPIC", "sensor-data")
+	}
+
+	c.MongoUser = env.str("MONGO_USER", "")
+	c.MongoPass = env.secret("MONGO_PASS")
+	c.MongoURI = env.secret("MONGO_URI")
+	if c.MongoURI == "" && mongoBackend {
+		c.MongoHost = env.required("MONGO_HOST")
+	}
+	c.MongoPort = env.port("MONGO_PORT", "27017")
+	if mongoBackend {
+		c.MongoDatabase = env.required("MONGO_DATABASE")
+		c.MongoCollection = env.required("MONGO_COLLECTION")
+	}
+	if v := env.str("TOPIC_COLLECTION_MAP", ""); v != "" {
+		routes, err := parseCollectionRoutes(v)
+		if err != nil {
+			env.fail("TOPIC_COLLECTION_MAP: %v", err)
+		}
+		c.CollectionRoutes = routes
+	}
+	c.RouteByField = env.str("ROUTE_BY_FIELD", "")
+	if c.RouteByField != "" {
+		defaultPrefix := ""
+		if c.MongoCollection != "" {
+			defaultPrefix = c.MongoCollection + "_"
+		}
+		c.RouteCollectionPrefix = env.str("ROUTE_COLLECTION_PREFIX", defaultPrefix)
+		if strings.Contains(c.RouteCollectionPrefix, "$") || strings.HasPrefix(c.RouteCollectionPrefix, "system.") {
+			env.fail("ROUTE_COLLECTION_PREFIX: %q is not a valid collection name prefix", c.RouteCollectionPrefix)
+		}
+		values, err := parseRouteValues(env.str("ROUTE_ALLOWED_VALUES", ""))
+		if err != nil {
+			env.fail("ROUTE_ALLOWED_VALUES: %v", err)
+		}
+		c.RouteAllowedValues = values
+	}
+	c.LatestCollection = env.str("LATEST_COLLECTION", "")
+	c.DLQCollection = env.str("DLQ_COLLECTION", "")
+	c.MongoRetryBase = env.duration("MONGO_RETRY_BASE", time.Second)
+	c.MongoRetryMax = env.duration("MONGO_RETRY_MAX", 30*time.Second)
+	c.MongoConnectTimeout = env.duration("MONGO_CONNECT_TIMEOUT", 10*time.Second)
+	c.MongoInsertTimeout = env.duration("MONGO_INSERT_TIMEOUT", 5*time.Second)
+	c.InsertRetries = env.integer("INSERT_RETRIES", 2, 0)
+	c.InsertRetryDelay = env.duration("INSERT_RETRY_DELAY", 200*time.Millisecond)
+	c.MongoMaxPool = uint64(env.integer("MONGO_MAX_POOL_SIZE", 100, 1))
+	c.MongoMinPool = uint64(env.integer("MONGO_MIN_POOL_SIZE", 0, 0))
+	if c.MongoMinPool > c.MongoMaxPool {
+		env.fail("MONGO_MIN_POOL_SIZE must not exceed MONGO_MAX_POOL_SIZE")
+	}
+	wc := &writeconcern.WriteConcern{W: "majority"}
+	if v := strings.ToLower(env.str("MONGO_WRITE_CONCERN", "majority")); v != "majority" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			env.fail("MONGO_WRITE_CONCERN: %q must be majority or a number of nodes >= 1", v)
+		}
+		wc.W = n
+	}
+	if env.get("MONGO_JOURNAL") != "" {
+		j := env.boolean("MONGO_JOURNAL")
+		wc.Journal = &j
+	}
+	if env.get("MONGO_WTIMEOUT") != "" {
+		wc.WTimeout = env.duration("MONGO_WTIMEOUT", 0)
+	}
+	c.MongoWriteConcern = wc
+	c.MongoVersionCheck = strings.ToLower(env.str("MONGO_VERSION_CHECK", "warn"))
+	switch c.MongoVersionCheck {
+	case "warn", "fail", "off":
+	default:
+		env.fail("MONGO_VERSION_CHECK: %q must be warn, fail or off", c.MongoVersionCheck)
+	}
+	c.DLQRetryInterval = env.duration("DLQ_RETRY_INTERVAL", time.Minute)
+	c.DLQMaxRetries = env.integer("DLQ_MAX_RETRIES", 0, 0)
+	c.QuarantineCollection = env.str("QUARANTINE_COLLECTION", "quarantine")
+	if c.DLQMaxRetries > 0 {
+		switch {
+		case c.DLQCollection == "":
+			env.fail("DLQ_MAX_RETRIES requires DLQ_COLLECTION")
+		case c.QuarantineCollection == c.DLQCollection:
+			env.fail("QUARANTINE_COLLECTION must differ from DLQ_COLLECTION")
+		}
+	}
+	c.OfflineTimeout = env.duration("OFFLINE_TIMEOUT", 0)
+	c.PresenceCollection = env.str("PRESENCE_COLLECTION", "")
+	c.PresenceTopicPrefix = strings.TrimSuffix(env.str("PRESENCE_TOPIC_PREFIX", ""), "/")
+	c.RollupInterval = env.duration("ROLLUP_INTERVAL", 0)
+	if c.RollupInterval != 0 && c.RollupInterval < time.Second {
+		env.fail("ROLLUP_INTERVAL: must be at least 1s")
+	}
+	c.RollupCollection = env.str("ROLLUP_COLLECTION", "rollups")
+	c.CreateIndexes = env.boolean("CREATE_INDEXES")
+	c.DataRetention = env.duration("DATA_RETENTION", 0)
+	c.TimeSeries = env.boolean("TIMESERIES")
+	c.TimeSeriesGranularity = env.str("TIMESERIES_GRANULARITY", "seconds")
+	switch c.TimeSeriesGranularity {
+	case "seconds", "minutes", "hours":
+	default:
+		env.fail("TIMESERIES_GRANULARITY: %q must be seconds, minutes or hours", c.TimeSeriesGranularity)
+	}
+	if c.DataRetention != 0 && c.DataRetention < time.Second {
+		env.fail("DATA_RETENTION: must be at least 1s")
+	}
+	// TTL indexes take expireAfterSeconds as a 32-bit integer.
+	if c.DataRetention > math.MaxInt32*time.Second {
+		env.fail("DATA_RETENTION: must be at most %s", math.MaxInt32*time.Second)
+	}
+
+	c.MQTTTLS = env.boolean("MQTT_TLS_ENABLE")
+	c.MQTTCACert = env.str("MQTT_CA_CERT", "")
+	c.MQTTClientCert = env.str("MQTT_CLIENT_CERT", "")
+	c.MQTTClientKey = env.str("MQTT_CLIENT_KEY", "")
+	c.MQTTTLSInsecure = env.boolean("MQTT_TLS_INSECURE")
+	if (c.MQTTClientCert == "") != (c.MQTTClientKey == "") {
+		env.fail("MQTT_CLIENT_CERT and MQTT_CLIENT_KEY must be set together")
+	}
+	c.MQTTTransport = strings.ToLower(env.str("MQTT_TRANSPORT", "tcp"))
+	switch c.MQTTTransport {
+	case "tcp":
+	case "ws":
+		if c.MQTTTLS {
+			env.fail("MQTT_TLS_ENABLE: use MQTT_TRANSPORT=wss for WebSockets over TLS")
+		}
+	case "wss":
+		c.MQTTTLS = true
+	default:
+		env.fail("MQTT_TRANSPORT: %q must be tcp, ws or wss", c.MQTTTransport)
+	}
+	c.MQTTWSPath = env.str("MQTT_WS_PATH", "/mqtt")
+	if !strings.HasPrefix(c.MQTTWSPath, "/") {
+		env.fail("MQTT_WS_PATH: %q must start with /", c.MQTTWSPath)
+	}
+
+	defaultPort := "1883"
+	switch {
+	case c.MQTTTransport == "ws":
+		defaultPort = "80"
+	case c.MQTTTransport == "wss":
+		defaultPort = "443"
+	case c.MQTTTLS:
+		defaultPort = "8883"
+	}
+	port := env.port("MQTT_PORT", defaultPort)
+	brokers := env.str("MQTT_BROKERS", "")
+	if brokers == "" {
+		brokers = env.required("MQTT_BROKER")
+	}
+	for _, b := range strings.Split(brokers, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, port)
+		}
+		c.MQTTBrokers = append(c.MQTTBrokers, b)
+	}
+	if len(c.MQTTBrokers) == 0 && brokers != "" {
+		env.fail("MQTT_BROKERS: no brokers given")
+	}
+	switch v := env.str("MQTT_VERSION", "3"); v {
+	case "3":
+		c.MQTTVersion = 3
+	case "5":
+		c.MQTTVersion = 5
+	default:
+		env.fail("MQTT_VERSION: %q is not supported (must be 3 or 5)", v)
+	}
+	c.MQTTConnectRetry = env.duration("MQTT_CONNECT_RETRY_INTERVAL", 5*time.Second)
+	c.MQTTMaxReconnect = env.duration("MQTT_MAX_RECONNECT_INTERVAL", time.Minute)
+	if c.MQTTMaxReconnect < c.MQTTConnectRetry {
+		env.fail("MQTT_MAX_RECONNECT_INTERVAL must not be shorter than MQTT_CONNECT_RETRY_INTERVAL")
+	}
+	c.MQTTClientID = env.str("MQTT_CLIENT_ID", "")
+	if c.MQTTClientID == "" {
+		c.MQTTClientID = defaultClientID()
+	}
+	c.MQTTStoreDir = env.str("MQTT_STORE_DIR", "")
+	c.MQTTUsername = env.secret("MQTT_USERNAME")
+	c.MQTTPassword = env.secret("MQTT_PASSWORD")
+
+	qos := byte(0)
+	if v := env.str("MQTT_QOS", ""); v != "" {
+		q, err := parseQoS(v)
+		if err != nil {
+			env.fail("MQTT_QOS: %v", err)
+		}
+		qos = q
+	}
+	topics := env.str("MQTT_TOPICS", "")
+	if topics == "" {
+		topics = env.str("MQTT_TOPIC", "mesh/data/") + "#"
+	}
+	subs, err := parseSubscriptions(topics, qos)
+	if err != nil {
+		env.fail("MQTT_TOPICS: %v", err)
+	}
+	c.Subscriptions = subs
+	c.MQTTPersistentSession = c.MQTTStoreDir != ""
+	for _, sub := range c.Subscriptions {
+		if sub.QoS > 0 {
+			c.MQTTPersistentSession = true
+		}
+	}
+	if env.get("MQTT_CLEAN_SESSION") != "" {
+		c.MQTTPersistentSession = !env.boolean("MQTT_CLEAN_SESSION")
+		switch {
+		case c.MQTTPersistentSession && env.get("MQTT_CLIENT_ID") == "":
+			// The broker finds the session by client ID.
+			env.fail("MQTT_CLEAN_SESSION=false requires a fixed MQTT_CLIENT_ID")
+		case !c.MQTTPersistentSession && c.MQTTStoreDir != "":
+			env.fail("MQTT_STORE_DIR requires MQTT_CLEAN_SESSION=false")
+		}
+	}
+	defaultExpiry := time.Duration(0)
+	if c.MQTTPersistentSession {
+		defaultExpiry = time.Hour
+	}
+	c.MQTTSessionExpiry = env.duration("MQTT_SESSION_EXPIRY", defaultExpiry)
+	if env.get("MQTT_SESSION_EXPIRY") != "" && c.MQTTVersion != 5 {
+		env.fail("MQTT_SESSION_EXPIRY requires MQTT_VERSION=5")
+	}
+	if c.MQTTSessionExpiry > math.MaxUint32*time.Second {
+		env.fail("MQTT_SESSION_EXPIRY: must be at most %d seconds", uint32(math.MaxUint32))
+	}
+	c.ManualAck = env.boolean("MANUAL_ACK")
+	c.MQTTSharedGroup = env.str("MQTT_SHARED_GROUP", "")
+	if c.MQTTSharedGroup != "" {
+		if strings.ContainsAny(c.MQTTSharedGroup, "/+#") {
+			env.fail("MQTT_SHARED_GROUP: %q must not contain /, + or #", c.MQTTSharedGroup)
+		}
+		for _, sub := range c.Subscriptions {
+			if strings.HasPrefix(sub.Filter, "$share/") {
+				env.fail("MQTT_TOPICS: %q is already a shared subscription; drop the prefix when MQTT_SHARED_GROUP is set", sub.Filter)
+			}
+		}
+	}
+
+	if v := env.str("DEVICE_ID_PATTERN", ""); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			env.fail("DEVICE_ID_PATTERN: %v", err)
+		}
+		c.DeviceIDPattern = re
+	}
+	if v := env.str("DEVICE_ID_TOPIC_INDEX", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			env.fail("DEVICE_ID_TOPIC_INDEX: %q is not an integer", v)
+		}
+		c.DeviceIDIndex = &n
+	}
+
+	c.LWTTopic = env.str("MQTT_LWT_TOPIC", "")
+	c.LWTPayload = env.str("MQTT_LWT_PAYLOAD", "offline")
+	c.OnlinePayload = env.str("MQTT_ONLINE_PAYLOAD", "online")
+	if v := env.str("MQTT_LWT_QOS", ""); v != "" {
+		q, err := parseQoS(v)
+		if err != nil {
+			env.fail("MQTT_LWT_QOS: %v", err)
+		}
+		c.LWTQoS = q
+	}
+	c.LWTRetained = env.boolean("MQTT_LWT_RETAIN")
+
+	c.Decompress = strings.ToLower(env.str("DECOMPRESS", "none"))
+	switch c.Decompress {
+	case "none", "gzip", "auto":
+	default:
+		env.fail("DECOMPRESS: %q must be none, gzip or auto", c.Decompress)
+	}
+	c.PayloadEncoding = strings.ToLower(env.str("PAYLOAD_ENCODING", "text"))
+	switch c.PayloadEncoding {
+	case "text", "base64", "auto":
+	default:
+		env.fail("PAYLOAD_ENCODING: %q must be text, base64 or auto", c.PayloadEncoding)
+	}
+	if v := env.str("PAYLOAD_CHARSET", ""); v != "" {
+		charset, err := ianaindex.IANA.Encoding(v)
+		switch {
+		case err != nil || charset == nil:
+			env.fail("PAYLOAD_CHARSET: %q is not a supported charset", v)
+		case c.PayloadEncoding == "base64":
+			env.fail("PAYLOAD_CHARSET: cannot be used with PAYLOAD_ENCODING=base64, which stores payloads as bytes")
+		default:
+			c.PayloadCharset = charset
+		}
+	}
+	c.AckTopicPrefix = strings.TrimSuffix(env.str("ACK_TOPIC_PREFIX", ""), "/")
+	if v := env.str("ACK_QOS", ""); v != "" {
+		q, err := parseQoS(v)
+		if err != nil {
+			env.fail("ACK_QOS: %v", err)
+		}
+		c.AckQoS = q
+	}
+	c.StatsTopic = env.str("STATS_TOPIC", "")
+	if strings.ContainsAny(c.StatsTopic, "+#") {
+		env.fail("STATS_TOPIC: %q must not contain wildcards", c.StatsTopic)
+	}
+	c.StatsInterval = env.duration("STATS_INTERVAL", time.Minute)
+	c.ParseJSONPayload = env.boolean("PARSE_JSON_PAYLOAD")
+	c.FlattenPayload = env.boolean("FLATTEN_PAYLOAD")
+	c.FlattenSeparator = env.str("FLATTEN_SEPARATOR", "_")
+	switch {
+	case c.FlattenSeparator == "":
+		env.fail("FLATTEN_SEPARATOR must not be empty")
+	case strings.ContainsAny(c.FlattenSeparator, ".$"):
+		// MongoDB reads dots in query and index paths as nesting, so
+		// flattened names containing them could not be queried.
+		env.fail("FLATTEN_SEPARATOR: %q must not contain '.' or '$'", c.FlattenSeparator)
+	}
+	c.StoreMQTTMeta = env.boolean("STORE_MQTT_META")
+	c.RetainedAction = strings.ToLower(env.str("RETAINED_ACTION", "store"))
+	switch c.RetainedAction {
+	case "store", "skip", "flag":
+	default:
+		env.fail("RETAINED_ACTION: %q must be store, skip or flag", c.RetainedAction)
+	}
+	if v := env.str("FORMAT_BY_TOPIC", ""); v != "" {
+		routes, err := parseFormatRoutes(v)
+		if err != nil {
+			env.fail("FORMAT_BY_TOPIC: %v", err)
+		}
+		c.FormatRoutes = routes
+	}
+	if v := env.str("CSV_HEADERS", ""); v != "" {
+		headers, err := parseCSVHeaders(v)
+		if err != nil {
+			env.fail("CSV_HEADERS: %v", err)
+		}
+		if !slices.ContainsFunc(c.FormatRoutes, func(r formatRoute) bool { return r.Format == "csv" }) {
+			env.fail("CSV_HEADERS requires a csv topic in FORMAT_BY_TOPIC")
+		}
+		c.CSVHeaders = headers
+	}
+	if v := env.str("TRANSFORM_RULES", ""); v != "" {
+		rules, err := parseTransformRules(v)
+		if err != nil {
+			env.fail("TRANSFORM_RULES: %v", err)
+		}
+		c.TransformRules = rules
+	}
+	if v := env.str("EXTRACT_FIELDS", ""); v != "" {
+		fields, err := parseExtractFields(v)
+		if err != nil {
+			env.fail("EXTRACT_FIELDS: %v", err)
+		}
+		c.ExtractFields = fields
+	}
+	if v := env.str("TOPIC_TEMPLATE", ""); v != "" {
+		t, err := parseTopicTemplate(v)
+		if err != nil {
+			env.fail("TOPIC_TEMPLATE: %v", err)
+		} else {
+			for _, name := range t.fields() {
+				if slices.Contains(c.ExtractFields, name) {
+					env.fail("TOPIC_TEMPLATE: %q is also in EXTRACT_FIELDS", name)
+				}
+			}
+		}
+		c.TopicTemplate = t
+	}
+
+	c.Site = env.str("SITE", "")
+	c.GatewayID = env.str("GATEWAY_ID", "")
+	c.Environment = env.str("ENV", "")
+	c.MaxPayloadBytes = env.integer("MAX_PAYLOAD_BYTES", 0, 0)
+	c.TimestampField = env.str("TIMESTAMP_FIELD", "")
+	c.MaxMessageAge = env.duration("MAX_MESSAGE_AGE", 0)
+	if c.MaxMessageAge != 0 && c.TimestampField == "" {
+		env.fail("MAX_MESSAGE_AGE requires TIMESTAMP_FIELD")
+	}
+	c.StaleAction = strings.ToLower(env.str("STALE_ACTION", "drop"))
+	switch c.StaleAction {
+	case "drop", "flag":
+	case "archive":
+		c.StaleCollection = env.required("STALE_COLLECTION")
+		if c.StaleCollection != "" && c.StaleCollection == c.MongoCollection {
+			env.fail("STALE_COLLECTION must differ from MONGO_COLLECTION")
+		}
+	default:
+		env.fail("STALE_ACTION: %q must be drop, flag or archive", c.StaleAction)
+	}
+	precision, err := parseTimestampPrecision(env.str("TIMESTAMP_PRECISION", "ns"))
+	if err != nil {
+		env.fail("TIMESTAMP_PRECISION: %v", err)
+	}
+	c.TimestampPrecision = precision
+	c.TimestampFormat = env.str("TIMESTAMP_FORMAT", "date")
+	switch c.TimestampFormat {
+	case "date":
+	case "epoch_ms":
+		// TTL indexes and time-series collections need a BSON date.
+		if c.DataRetention != 0 {
+			env.fail("DATA_RETENTION requires TIMESTAMP_FORMAT=date")
+		}
+		if c.TimeSeries {
+			env.fail("TIMESERIES requires TIMESTAMP_FORMAT=date")
+		}
+	default:
+		env.fail("TIMESTAMP_FORMAT: %q must be date or epoch_ms", c.TimestampFormat)
+	}
+	if !mongoBackend {
+		mongoOnly := []struct {
+			key string
+			set bool
+		}{
+			{"LATEST_COLLECTION", c.LatestCollection != ""},
+			{"DLQ_COLLECTION", c.DLQCollection != ""},
+			{"PRESENCE_COLLECTION", c.PresenceCollection != ""},
+			{"ROLLUP_INTERVAL", c.RollupInterval != 0},
+			{"CREATE_INDEXES", c.CreateIndexes},
+			{"DATA_RETENTION", c.DataRetention != 0},
+			{"TIMESERIES", c.TimeSeries},
+			{"TIMESTAMP_FORMAT=epoch_ms", c.TimestampFormat == "epoch_ms"},
+		}
+		for _, opt := range mongoOnly {
+			if opt.set {
+				env.fail("%s requires STORAGE_BACKEND=mongo", opt.key)
+			}
+		}
+	}
+
+	c.DedupWindow = env.duration("DEDUP_WINDOW", 0)
+	c.DedupMaxEntries = env.integer("DEDUP_MAX_ENTRIES", 10000, 1)
+	c.SampleInterval = env.duration("SAMPLE_INTERVAL", 0)
+	if v := env.str("SAMPLE_INTERVAL_BY_TOPIC", ""); v != "" {
+		routes, err := parseSampleRoutes(v)
+		if err != nil {
+			env.fail("SAMPLE_INTERVAL_BY_TOPIC: %v", err)
+		}
+		c.SampleRoutes = routes
+	}
+	c.SampleMode = strings.ToLower(env.str("SAMPLE_MODE", "drop"))
+	switch c.SampleMode {
+	case "drop", "average":
+	default:
+		env.fail("SAMPLE_MODE: %q must be drop or average", c.SampleMode)
+	}
+
+	if v := env.str("RATE_LIMIT", ""); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r <= 0 || math.IsInf(r, 0) {
+			env.fail("RATE_LIMIT: %q must be a positive number of readings per second", v)
+		}
+		c.RateLimit = r
+	}
+	c.RateBurst = env.integer("RATE_BURST", int(math.Max(1, math.Ceil(c.RateLimit))), 1)
+
+	c.Encryption = env.boolean("ENCRYPTION")
+	if v := env.str("ENCRYPT_API_URL", ""); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			env.fail("ENCRYPT_API_URL: %q must be an http or https URL", v)
+		}
+		c.EncryptAPIURL = u
+	} else if c.Encryption {
+		env.fail("ENCRYPT_API_URL is required when ENCRYPTION=true")
+	}
+	c.EncryptPath = env.str("ENCRYPT_PATH", "encrypt")
+	if v := env.str("ENCRYPT_TOPICS", ""); v != "" {
+		c.EncryptTopics = parseEncryptTopics(v)
+		if !c.Encryption {
+			env.fail("ENCRYPT_TOPICS requires ENCRYPTION=true")
+		}
+	}
+	if v := env.str("ENCRYPT_FIELDS", ""); v != "" {
+		c.EncryptFields = parseEncryptFields(v)
+		if slices.Contains(c.EncryptFields, c.RouteByField) {
+			env.fail("ROUTE_BY_FIELD: %q is also in ENCRYPT_FIELDS", c.RouteByField)
+		}
+		if !c.Encryption {
+			env.fail("ENCRYPT_FIELDS requires ENCRYPTION=true")
+		}
+	}
+	if c.Encryption && len(c.EncryptFields) == 0 && c.RollupInterval != 0 {
+		// Rollups are computed from the plaintext and are not encrypted.
+		env.fail("ROLLUP_INTERVAL requires ENCRYPT_FIELDS when ENCRYPTION=true")
+	}
+	c.EncryptKeyIDField = env.str("ENCRYPT_KEY_ID_FIELD", "key_id")
+	c.EncryptIVField = env.str("ENCRYPT_IV_FIELD", "iv")
+	for _, f := range []struct{ key, name string }{{"ENCRYPT_KEY_ID_FIELD", c.EncryptKeyIDField}, {"ENCRYPT_IV_FIELD", c.EncryptIVField}} {
+		if f.name == "text" || f.name == "result" {
+			env.fail("%s: %q is used by the cipher API protocol", f.key, f.name)
+		}
+	}
+	if c.EncryptKeyIDField != "" && c.EncryptKeyIDField == c.EncryptIVField {
+		env.fail("ENCRYPT_KEY_ID_FIELD and ENCRYPT_IV_FIELD must differ")
+	}
+	c.EncryptAPIToken = env.secret("ENCRYPT_API_TOKEN")
+	c.EncryptAPIKey = env.secret("ENCRYPT_API_KEY")
+	c.EncryptAPIKeyHeader = env.str("ENCRYPT_API_KEY_HEADER", "X-API-Key")
+	if strings.ContainsAny(c.EncryptAPIKeyHeader, " \t\r\n:") {
+		env.fail("ENCRYPT_API_KEY_HEADER: %q is not a valid header name", c.EncryptAPIKeyHeader)
+	}
+	c.EncryptRetries = env.integer("ENCRYPT_RETRIES", 3, 0)
+	c.EncryptRetryDelay = env.duration("ENCRYPT_RETRY_DELAY", 500*time.Millisecond)
+	c.EncryptTimeout = env.duration("ENCRYPT_TIMEOUT", 5*time.Second)
+	c.EncryptMaxIdleConns = env.integer("ENCRYPT_MAX_IDLE_CONNS", 16, 1)
+	c.EncryptBatchSize = env.integer("ENCRYPT_BATCH_SIZE", 1, 1)
+	c.EncryptBatchInterval = env.duration("ENCRYPT_BATCH_INTERVAL", 100*time.Millisecond)
+	c.EncryptConcurrency = env.integer("ENCRYPT_CONCURRENCY", 0, 0)
+	if c.EncryptConcurrency > 0 && !c.Encryption {
+		env.fail("ENCRYPT_CONCURRENCY requires ENCRYPTION=true")
+	}
+	c.CipherBreakerThreshold = env.integer("CIPHER_BREAKER_THRESHOLD", 5, 0)
+	c.CipherBreakerCooldown = env.duration("CIPHER_BREAKER_COOLDOWN", 30*time.Second)
+	defaultFallback := "drop"
+	if c.DLQCollection != "" {
+		defaultFallback = "dlq"
+	}
+	c.EncryptFallback = strings.ToLower(env.str("ENCRYPT_FALLBACK", defaultFallback))
+	switch c.EncryptFallback {
+	case "drop", "plaintext":
+	case "dlq":
+		if c.DLQCollection == "" {
+			env.fail("ENCRYPT_FALLBACK=dlq requires DLQ_COLLECTION")
+		}
+	default:
+		env.fail("ENCRYPT_FALLBACK: %q must be drop, plaintext or dlq", c.EncryptFallback)
+	}
+
+	c.SchemaPath = env.str("SCHEMA_PATH", "")
+	c.SchemaInvalidAction = strings.ToLower(env.str("SCHEMA_INVALID_ACTION", defaultFallback))
+	switch c.SchemaInvalidAction {
+	case "drop":
+	case "dlq":
+		if c.DLQCollection == "" {
+			env.fail("SCHEMA_INVALID_ACTION=dlq requires DLQ_COLLECTION")
+		}
+	default:
+		env.fail("SCHEMA_INVALID_ACTION: %q must be drop or dlq", c.SchemaInvalidAction)
+	}
+
+	c.Workers = env.integer("WORKERS", 0, 0)
+	c.WorkerQueueSize = env.integer("WORKER_QUEUE_SIZE", 1000, 1)
+	c.QueueFullPolicy = strings.ToLower(env.str("QUEUE_FULL_POLICY", "block"))
+	if c.QueueFullPolicy != "block" && c.QueueFullPolicy != "drop" {
+		env.fail("QUEUE_FULL_POLICY: %q must be block or drop", c.QueueFullPolicy)
+	}
+	c.MaxInflight = env.integer("MAX_INFLIGHT", 0, 0)
+	c.OverflowPolicy = strings.ToLower(env.str("OVERFLOW_POLICY", "block"))
+	if c.OverflowPolicy != "block" && c.OverflowPolicy != "drop" {
+		env.fail("OVERFLOW_POLICY: %q must be block or drop", c.OverflowPolicy)
+	}
+
+	c.BatchSize = env.integer("BATCH_SIZE", 100, 1)
+	c.BatchInterval = env.duration("BATCH_INTERVAL", 2*time.Second)
+
+	c.BufferPath = env.str("BUFFER_PATH", "")
+	c.BufferMaxRecords = env.integer("BUFFER_MAX_RECORDS", 100000, 1)
+	c.BufferReplayInterval = env.duration("BUFFER_REPLAY_INTERVAL", 30*time.Second)
+
+	c.HealthPort = env.port("HEALTH_PORT", "8080")
+	c.MetricsPort = env.port("METRICS_PORT", "2112")
+	if env.str("API_PORT", "") != "" {
+		c.APIPort = env.port("API_PORT", "")
+		c.APIToken = env.secret("API_TOKEN")
+		if c.APIToken == "" {
+			env.fail("API_TOKEN is required when API_PORT is set")
+		}
+	}
+	c.AdminToken = env.secret("ADMIN_TOKEN")
+	if env.str("GRPC_PORT", "") != "" {
+		c.GRPCPort = env.port("GRPC_PORT", "")
+	}
+	if env.str("INGEST_PORT", "") != "" {
+		c.IngestPort = env.port("INGEST_PORT", "")
+		c.IngestAPIKey = env.secret("INGEST_API_KEY")
+		if c.IngestAPIKey == "" {
+			env.fail("INGEST_API_KEY is required when INGEST_PORT is set")
+		}
+	}
+
+	switch v := strings.ToLower(env.str("LOG_LEVEL", "info")); v {
+	case "debug":
+		c.LogLevel = slog.LevelDebug
+	case "info":
+		c.LogLevel = slog.LevelInfo
+	case "warn", "warning":
+		c.LogLevel = slog.LevelWarn
+	case "error":
+		c.LogLevel = slog.LevelError
+	default:
+		env.fail("LOG_LEVEL: %q must be debug, info, warn or error", v)
+	}
+	c.LogFormat = strings.ToLower(env.str("LOG_FORMAT", "text"))
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		env.fail("LOG_FORMAT: %q must be text or json", c.LogFormat)
+	}
+
+	c.ShutdownTimeout = env.duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	c.MessageTimeout = env.duration("MESSAGE_TIMEOUT", 0)
+	c.StartupJitter = env.duration("STARTUP_JITTER", 0)
+	c.DryRun = env.boolean("DRY_RUN")
+	c.OTLPEndpoint = env.str("OTEL_EXPORTER_OTLP_ENDPOINT", env.str("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""))
+
+	if len(env.errs) > 0 {
+		return c, errors.New("invalid configuration:\n  - " + strings.Join(env.errs, "\n  - "))
+	}
+	return c, nil
+}
+
+// defaultClientID derives a client ID that is unique per host, falling back
+// to a random suffix when the host name is unknown.
+func defaultClientID() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return "mqtt-orchestrator-" + host
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "mqtt-orchestrator-" + hex.EncodeToString(suffix)
+}
+
+// envReader reads typed settings from the environment, falling back to the
+// CONFIG_FILE values, and collects every problem instead of stopping at the
+// first one.
+type envReader struct {
+	file map[string]string
+	errs []string
+}
+
+func (r *envReader) get(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return r.file[key]
+}
+
+func (r *envReader) fail(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func (r *envReader) str(key, def string) string {
+	if v := r.get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// secret reads key from the file named by key+"_FILE", as mounted by Docker
+// and Kubernetes secrets, or else like str. Trailing newlines of the file
+// are dropped.
+func (r *envReader) secret(key string) string {
+	path := r.get(key + "_FILE")
+	if path == "" {
+		return r.get(key)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		r.fail("%s_FILE: %v", key, err)
+		return ""
+	}
+	return strings.TrimRight(string(b), "\r\n")
+}
+
+func (r *envReader) required(key string) string {
+	v := r.get(key)
+	if v == "" {
+		r.fail("%s is required", key)
+	}
+	return v
+}
+
+func (r *envReader) boolean(key string) bool {
+	v := r.get(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		r.fail("%s: %q is not a boolean", key, v)
+	}
+	return b
+}
+
+func (r *envReader) integer(key string, def, min int) int {
+	v := r.get(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		r.fail("%s: %q must be an integer >= %d", key, v, min)
+		return def
+	}
+	return n
+}
+
+func (r *envReader) duration(key string, def time.Duration) time.Duration {
+	v := r.get(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		r.fail("%s: %q must be a positive duration such as 500ms or 10s", key, v)
+		return def
+	}
+	return d
+}
+
+func (r *envReader) port(key, def string) string {
+	v := r.str(key, def)
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+		r.fail("%s: %q is not a valid port", key, v)
+	}
+	return v
+}
@@ -0,0 +1,68 @@
+// config_test.go
+package orchestrator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigValidation(t *testing.T) {
+	base := map[string]string{
+		"CONFIG_FILE":      "",
+		"MQTT_BROKER":      "localhost",
+		"MONGO_HOST":       "localhost",
+		"MONGO_DATABASE":   "iot_mesh",
+		"MONGO_COLLECTION": "sensor_data",
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr []string
+	}{
+		{name: "minimal"},
+		{name: "missing broker", env: map[string]string{"MQTT_BROKER": ""}, wantErr: []string{"MQTT_BROKER is required"}},
+		{name: "missing database", env: map[string]string{"MONGO_DATABASE": ""}, wantErr: []string{"MONGO_DATABASE is required"}},
+		{name: "batch size below minimum", env: map[string]string{"BATCH_SIZE": "0"}, wantErr: []string{`BATCH_SIZE: "0" must be an integer >= 1`}},
+		{name: "integer not a number", env: map[string]string{"BATCH_SIZE": "many"}, wantErr: []string{"BATCH_SIZE:"}},
+		{name: "invalid port", env: map[string]string{"HEALTH_PORT": "70000"}, wantErr: []string{`HEALTH_PORT: "70000" is not a valid port`}},
+		{name: "negative duration", env: map[string]string{"SHUTDOWN_TIMEOUT": "-1s"}, wantErr: []string{"SHUTDOWN_TIMEOUT:"}},
+		{name: "invalid boolean", env: map[string]string{"DRY_RUN": "maybe"}, wantErr: []string{`DRY_RUN: "maybe" is not a boolean`}},
+		{name: "unknown log level", env: map[string]string{"LOG_LEVEL": "verbose"}, wantErr: []string{"LOG_LEVEL:"}},
+		{name: "unknown log format", env: map[string]string{"LOG_FORMAT": "xml"}, wantErr: []string{"LOG_FORMAT:"}},
+		{
+			name:    "invalid route prefix",
+			env:     map[string]string{"ROUTE_BY_FIELD": "tenant", "ROUTE_COLLECTION_PREFIX": "system.tenant_"},
+			wantErr: []string{"ROUTE_COLLECTION_PREFIX:"},
+		},
+		{
+			name:    "every problem reported",
+			env:     map[string]string{"MONGO_DATABASE": "", "BATCH_SIZE": "0", "LOG_FORMAT": "xml"},
+			wantErr: []string{"MONGO_DATABASE is required", "BATCH_SIZE:", "LOG_FORMAT:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range base {
+				t.Setenv(key, value)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := LoadConfig()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// configfile.go
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads CONFIG_FILE, a YAML or JSON object keyed by the same
+// names as the environment variables. JSON is valid YAML, so both go through
+// the YAML parser. Values are turned into the strings the variables would
+// hold: lists become comma-separated and objects become JSON, keeping their
+// key order (TOPIC_COLLECTION_MAP routes are matched in order).
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return map[string]string{}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("must be an object of setting names to values")
+	}
+
+	values := make(map[string]string, len(root.Content)/2)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+		for value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		switch {
+		case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+			continue
+		case value.Kind == yaml.ScalarNode:
+			values[key] = value.Value
+		case value.Kind == yaml.SequenceNode && scalarItems(value):
+			items := make([]string, len(value.Content))
+			for j, item := range value.Content {
+				items[j] = item.Value
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			var buf bytes.Buffer
+			if err := writeNodeJSON(&buf, value); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			values[key] = buf.String()
+		}
+	}
+	return values, nil
+}
+
+func scalarItems(n *yaml.Node) bool {
+	for _, item := range n.Content {
+		if item.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+// writeNodeJSON encodes n as JSON. Unlike decoding into a map first, it keeps
+// the order of object keys.
+func writeNodeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return writeNodeJSON(buf, n.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeNodeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeNodeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
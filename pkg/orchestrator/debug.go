@@ -0,0 +1,179 @@
+// debug.go
+package orchestrator
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// diagnostics remembers the latest outcomes GET /debug/status reports.
+type diagnostics struct {
+	mu                sync.Mutex
+	lastInsert        time.Time
+	lastInsertFailure time.Time
+	lastInsertError   string
+	lastCipherFailure time.Time
+	lastCipherError   string
+}
+
+func (d *diagnostics) insertSucceeded(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastInsert = now
+}
+
+func (d *diagnostics) insertFailed(now time.Time, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastInsertFailure = now
+	d.lastInsertError = err.Error()
+}
+
+func (d *diagnostics) cipherFailed(now time.Time, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastCipherFailure = now
+	d.lastCipherError = err.Error()
+}
+
+// debugStatus is the body of GET /debug/status. Times are null until the
+// event first happens.
+type debugStatus struct {
+	MQTT    debugMQTT    `json:"mqtt"`
+	Storage debugStorage `json:"storage"`
+	Cipher  *debugCipher `json:"cipher,omitempty"`
+	// Buffered counts the readings in the disk buffer, Queued those waiting
+	// for a worker or the batch writer.
+	Buffered int           `json:"buffered"`
+	Queued   int           `json:"queued"`
+	Config   configSummary `json:"config"`
+}
+
+type debugMQTT struct {
+	Connected     bool     `json:"connected"`
+	Subscriptions []string `json:"subscriptions"`
+}
+
+type debugStorage struct {
+	LastInsert        *time.Time `json:"last_insert"`
+	LastInsertFailure *time.Time `json:"last_insert_failure"`
+	LastInsertError   string     `json:"last_insert_error,omitempty"`
+}
+
+type debugCipher struct {
+	Breaker          string     `json:"breaker"`
+	LastFailure      *time.Time `json:"last_failure"`
+	LastFailureError string     `json:"last_error,omitempty"`
+}
+
+// configSummary is the part of the configuration worth checking first on a
+// misbehaving deployment. Credentials are left out, and URLs are reduced
+// to their scheme, host and path.
+type configSummary struct {
+	StorageBackend string   `json:"storage_backend"`
+	Mongo          string   `json:"mongo,omitempty"`
+	Database       string   `json:"database,omitempty"`
+	Collection     string   `json:"collection,omitempty"`
+	StorageFile    string   `json:"storage_file,omitempty"`
+	Brokers        []string `json:"mqtt_brokers"`
+	MQTTVersion    int      `json:"mqtt_version"`
+	MQTTTransport  string   `json:"mqtt_transport"`
+	MQTTTLS        bool     `json:"mqtt_tls"`
+	ClientID       string   `json:"mqtt_client_id"`
+	SharedGroup    string   `json:"mqtt_shared_group,omitempty"`
+	Encryption     bool     `json:"encryption"`
+	EncryptAPIURL  string   `json:"encrypt_api_url,omitempty"`
+	Workers        int      `json:"workers"`
+	BatchSize      int      `json:"batch_size"`
+	BufferPath     string   `json:"buffer_path,omitempty"`
+	DryRun         bool     `json:"dry_run"`
+	LogLevel       string   `json:"log_level"`
+}
+
+// handleDebugStatus serves GET /debug/status, a diagnostic view of the
+// connections, the latest failures and the configuration in effect.
+func (o *Orchestrator) handleDebugStatus(w http.ResponseWriter, r *http.Request) {
+	o.reloadMu.Lock()
+	cfg := o.applied
+	o.reloadMu.Unlock()
+
+	status := debugStatus{
+		MQTT:   debugMQTT{Connected: o.client.IsConnected(), Subscriptions: []string{}},
+		Config: summarizeConfig(cfg),
+	}
+	o.subsMu.RLock()
+	for _, sub := range o.subs {
+		status.MQTT.Subscriptions = append(status.MQTT.Subscriptions, sub.Filter)
+	}
+	o.subsMu.RUnlock()
+
+	o.diag.mu.Lock()
+	status.Storage = debugStorage{
+		LastInsert:        timeOrNil(o.diag.lastInsert),
+		LastInsertFailure: timeOrNil(o.diag.lastInsertFailure),
+		LastInsertError:   o.diag.lastInsertError,
+	}
+	if cfg.Encryption {
+		status.Cipher = &debugCipher{
+			Breaker:          o.cipherBreaker.stateName(),
+			LastFailure:      timeOrNil(o.diag.lastCipherFailure),
+			LastFailureError: o.diag.lastCipherError,
+		}
+	}
+	o.diag.mu.Unlock()
+
+	if o.diskBuf != nil {
+		status.Buffered = o.diskBuf.buffered()
+	}
+	status.Queued = len(o.batchQueue) + len(o.workQueue) + len(o.encryptQueue)
+	writeJSON(w, http.StatusOK, status)
+}
+
+func summarizeConfig(cfg Config) configSummary {
+	s := configSummary{
+		StorageBackend: cfg.StorageBackend,
+		Brokers:        cfg.MQTTBrokers,
+		MQTTVersion:    cfg.MQTTVersion,
+		MQTTTransport:  cfg.MQTTTransport,
+		MQTTTLS:        cfg.MQTTTLS,
+		ClientID:       cfg.MQTTClientID,
+		SharedGroup:    cfg.MQTTSharedGroup,
+		Encryption:     cfg.Encryption,
+		Workers:        cfg.Workers,
+		BatchSize:      cfg.BatchSize,
+		BufferPath:     cfg.BufferPath,
+		DryRun:         cfg.DryRun,
+		LogLevel:       cfg.LogLevel.String(),
+	}
+	if cfg.StorageBackend == "file" {
+		s.StorageFile = cfg.StorageFile
+	} else {
+		s.Database, s.Collection = cfg.MongoDatabase, cfg.MongoCollection
+		s.Mongo = cfg.MongoHost + ":" + cfg.MongoPort
+		if cfg.MongoURI != "" {
+			s.Mongo = "redacted"
+			if u, err := url.Parse(cfg.MongoURI); err == nil {
+				s.Mongo = redactURL(u)
+			}
+		}
+	}
+	if cfg.Encryption && cfg.EncryptAPIURL != nil {
+		s.EncryptAPIURL = redactURL(cfg.EncryptAPIURL)
+	}
+	return s
+}
+
+// redactURL drops the user info, query and fragment of u, any of which may
+// hold credentials.
+func redactURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,53 @@
+// decompress.go
+package orchestrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxDecompressedBytes caps decompression when MAX_PAYLOAD_BYTES is unset,
+// so a small compressed payload cannot expand without bound.
+const maxDecompressedBytes = 16 << 20
+
+// isGzip reports whether msg should be gunzipped under cfg.Decompress: always
+// for "gzip", and for "auto" when the payload starts with the gzip magic
+// bytes or a content-encoding user property says so.
+func (o *Orchestrator) isGzip(msg Message) bool {
+	switch o.cfg.Decompress {
+	case "gzip":
+		return true
+	case "auto":
+		if bytes.HasPrefix(msg.Payload, []byte{0x1f, 0x8b}) {
+			return true
+		}
+		return strings.EqualFold(msg.UserProperties["content-encoding"], "gzip")
+	}
+	return false
+}
+
+// gunzip decompresses payload, refusing output larger than the payload size
+// limit.
+func (o *Orchestrator) gunzip(payload []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	limit := int64(maxDecompressedBytes)
+	if o.cfg.MaxPayloadBytes > 0 {
+		limit = int64(o.cfg.MaxPayloadBytes)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,97 @@
+// dedup.go
+package orchestrator
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// deduplicator remembers the hashes of recent readings in an LRU list, so
+// redeliveries (QoS 1 after a reconnect, for instance) are stored only once.
+type deduplicator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	max     int
+	order   *list.List // front is the most recently stored
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type dedupEntry struct {
+	key  [sha256.Size]byte
+	seen time.Time
+}
+
+func (o *Orchestrator) openDeduplicator() {
+	if o.cfg.DedupWindow == 0 {
+		return
+	}
+	o.dedup = &deduplicator{
+		window:  o.cfg.DedupWindow,
+		max:     o.cfg.DedupMaxEntries,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+	slog.Info("Deduplication enabled", "component", "dedup", "window", o.cfg.DedupWindow, "max_entries", o.cfg.DedupMaxEntries)
+}
+
+// dedupKey is the hash of a device's payload.
+func dedupKey(deviceID string, payload []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(deviceID))
+	h.Write([]byte{0})
+	h.Write(payload)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// seen reports whether the same device sent the same payload within the
+// window. Readings that are not duplicates are recorded.
+func (d *deduplicator) seen(deviceID string, payload []byte, now time.Time) bool {
+	key := dedupKey(deviceID, payload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		entry := el.Value.(*dedupEntry)
+		if now.Sub(entry.seen) < d.window {
+			return true
+		}
+		// The window counts from the stored reading, so a device that keeps
+		// sending the same value is still stored once per window.
+		entry.seen = now
+		d.order.MoveToFront(el)
+		return false
+	}
+
+	d.entries[key] = d.order.PushFront(&dedupEntry{key: key, seen: now})
+
+	// Evict expired entries from the back, and the oldest ones beyond max.
+	for el := d.order.Back(); el != nil; el = d.order.Back() {
+		entry := el.Value.(*dedupEntry)
+		if d.order.Len() <= d.max && now.Sub(entry.seen) < d.window {
+			break
+		}
+		d.order.Remove(el)
+		delete(d.entries, entry.key)
+	}
+	return false
+}
+
+// forget removes the record of a payload whose reading was lost, so that a
+// redelivery is stored rather than skipped as a duplicate.
+func (d *deduplicator) forget(deviceID string, payload []byte) {
+	key := dedupKey(deviceID, payload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		d.order.Remove(el)
+		delete(d.entries, key)
+	}
+}
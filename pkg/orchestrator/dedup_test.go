@@ -0,0 +1,98 @@
+// dedup_test.go
+package orchestrator
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestDeduplicatorSeen(t *testing.T) {
+	type step struct {
+		at      time.Duration
+		device  string
+		payload string
+		forget  bool // forget the payload instead of checking it
+		want    bool
+	}
+	tests := []struct {
+		name   string
+		window time.Duration
+		max    int
+		steps  []step
+	}{
+		{
+			name:   "duplicate within window",
+			window: time.Minute,
+			max:    10,
+			steps: []step{
+				{at: 0, device: "a", payload: "1", want: false},
+				{at: 30 * time.Second, device: "a", payload: "1", want: true},
+			},
+		},
+		{
+			name:   "other device or payload",
+			window: time.Minute,
+			max:    10,
+			steps: []step{
+				{at: 0, device: "a", payload: "1", want: false},
+				{at: 0, device: "b", payload: "1", want: false},
+				{at: 0, device: "a", payload: "2", want: false},
+			},
+		},
+		{
+			name:   "window counts from the stored reading",
+			window: time.Minute,
+			max:    10,
+			steps: []step{
+				{at: 0, device: "a", payload: "1", want: false},
+				{at: 50 * time.Second, device: "a", payload: "1", want: true},
+				{at: 61 * time.Second, device: "a", payload: "1", want: false},
+				{at: 100 * time.Second, device: "a", payload: "1", want: true},
+			},
+		},
+		{
+			name:   "oldest evicted beyond max",
+			window: time.Minute,
+			max:    2,
+			steps: []step{
+				{at: 0, device: "a", payload: "1", want: false},
+				{at: 0, device: "b", payload: "1", want: false},
+				{at: 0, device: "c", payload: "1", want: false},
+				{at: 0, device: "a", payload: "1", want: false},
+			},
+		},
+		{
+			name:   "forgotten after a lost reading",
+			window: time.Minute,
+			max:    10,
+			steps: []step{
+				{at: 0, device: "a", payload: "1", want: false},
+				{device: "a", payload: "1", forget: true},
+				{at: time.Second, device: "a", payload: "1", want: false},
+				{at: 2 * time.Second, device: "a", payload: "1", want: true},
+			},
+		},
+	}
+	start := time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &deduplicator{
+				window:  tt.window,
+				max:     tt.max,
+				order:   list.New(),
+				entries: make(map[[sha256.Size]byte]*list.Element),
+			}
+			for i, s := range tt.steps {
+				if s.forget {
+					d.forget(s.device, []byte(s.payload))
+					continue
+				}
+				if got := d.seen(s.device, []byte(s.payload), start.Add(s.at)); got != s.want {
+					t.Errorf("step %d: seen(%s, %s) = %v, want %v", i, s.device, s.payload, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// dlq.go
+package orchestrator
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stages at which a reading can fail. A reading that failed to encrypt is
+// stored in plaintext and is encrypted again on retry; one that failed to
+// insert already holds its final payload. Readings that failed schema
+// validation or CSV_HEADERS parsing, and those the database rejected
+// permanently (duplicate key, document validation), are kept for inspection
+// and never retried.
+const (
+	stageValidate = "validate"
+	stageParse    = "parse"
+	stageEncrypt  = "encrypt"
+	stageInsert   = "insert"
+	stageRejected = "rejected"
+)
+
+// retryableStages selects the dead letters the retrier picks up.
+var retryableStages = bson.M{"$nin": bson.A{stageValidate, stageParse, stageRejected}}
+
+// DeadLetter is a reading that could not be stored, kept in DLQ_COLLECTION
+// until a retry succeeds, or moved to QUARANTINE_COLLECTION after
+// DLQ_MAX_RETRIES failed retries.
+type DeadLetter struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	Data        SensorData         `bson:"data"`
+	Collection  string             `bson:"collection,omitempty"`
+	Stage       string             `bson:"stage"`
+	Code        string             `bson:"code,omitempty"`
+	Reason      string             `bson:"reason"`
+	Retries     int                `bson:"retries"`
+	FailedAt    time.Time          `bson:"failed_at"`
+	LastAttempt time.Time          `bson:"last_attempt"`
+	// Errors is the history of failures, the first one and every retry.
+	Errors        []DeadLetterError `bson:"errors,omitempty"`
+	QuarantinedAt time.Time         `bson:"quarantined_at,omitempty"`
+}
+
+// DeadLetterError is one failure of a dead letter.
+type DeadLetterError struct {
+	Stage  string    `bson:"stage"`
+	Code   string    `bson:"code,omitempty"`
+	Reason string    `bson:"reason"`
+	At     time.Time `bson:"at"`
+}
+
+// writeDeadLetter records a reading that failed at failure.Stage. Without a
+// DLQ_COLLECTION, or if recording it fails, the reading is only logged. Its
+// message is acknowledged either way, so that it does not hold back the
+// acknowledgements of later messages.
+func (o *Orchestrator) writeDeadLetter(data SensorData, failure *ProcessError) {
+	defer data.acknowledge()
+
+	o.mongoMu.RLock()
+	collection := o.dlqCollection
+	o.mongoMu.RUnlock()
+
+	if collection == nil {
+		data.fail(failure)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.cfg.MongoInsertTimeout)
+	defer cancel()
+
+	now := time.Now()
+	entry := DeadLetter{
+		Data:        data,
+		Collection:  data.Collection,
+		Stage:       failure.Stage,
+		Code:        failure.Code,
+		Reason:      failure.Error(),
+		FailedAt:    now,
+		LastAttempt: now,
+		Errors:      []DeadLetterError{{Stage: failure.Stage, Code: failure.Code, Reason: failure.Error(), At: now}},
+	}
+	if _, err := collection.InsertOne(ctx, entry); err != nil {
+		slog.Error("Failed to record reading", "component", "dlq", "device_id", data.DeviceID, "message_id", data.MessageID, "error", err)
+		data.fail(failure)
+		return
+	}
+	slog.Warn("Recorded reading", "component", "dlq", "device_id", data.DeviceID, "message_id", data.MessageID, "stage", failure.Stage, "code", failure.Code, "reason", failure)
+}
+
+// startDLQRetrier periodically re-attempts dead letters until ctx is done.
+func (o *Orchestrator) startDLQRetrier(ctx context.Context) {
+	o.mongoMu.RLock()
+	enabled := o.dlqCollection != nil && !o.cfg.DryRun
+	o.mongoMu.RUnlock()
+
+	if !enabled {
+		close(o.dlqDone)
+		return
+	}
+
+	go func() {
+		defer close(o.dlqDone)
+
+		ticker := time.NewTicker(o.cfg.DLQRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				o.retryDeadLetters(ctx)
+			}
+		}
+	}()
+	slog.Info("Retrying dead letters periodically", "component", "dlq", "interval", o.cfg.DLQRetryInterval)
+}
+
+func (o *Orchestrator) retryDeadLetters(ctx context.Context) {
+	o.mongoMu.RLock()
+	collection := o.dlqCollection
+	o.mongoMu.RUnlock()
+
+	findCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "failed_at", Value: 1}}).SetLimit(100)
+	cursor, err := collection.Find(findCtx, bson.M{"stage": retryableStages}, opts)
+	if err != nil {
+		slog.Error("Failed to load dead letters", "component", "dlq", "error", err)
+		return
+	}
+	var entries []DeadLetter
+	if err := cursor.All(findCtx, &entries); err != nil {
+		slog.Error("Failed to decode dead letters", "component", "dlq", "error", err)
+		return
+	}
+
+	recovered := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if o.retryDeadLetter(entry) {
+			recovered++
+		}
+	}
+	if len(entries) > 0 {
+		slog.Info("Retried dead letters", "component", "dlq", "recovered", recovered, "attempted", len(entries))
+	}
+}
+
+// retryDeadLetter runs the entry through the remaining stages. On success the
+// entry is removed; otherwise its retry count, reason and error history are
+// updated, or it is quarantined once it has failed DLQ_MAX_RETRIES retries.
+func (o *Orchestrator) retryDeadLetter(entry DeadLetter) bool {
+	o.mongoMu.RLock()
+	collection, quarantine := o.dlqCollection, o.quarantineCollection
+	o.mongoMu.RUnlock()
+	entry.Data.Collection = entry.Collection
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.cfg.MongoInsertTimeout)
+	defer cancel()
+
+	err := func() error {
+		if entry.Stage == stageEncrypt {
+			sealed, err := o.encryptReading(o.workCtx, entry.Data)
+			if err != nil {
+				return err
+			}
+			entry.Data = sealed
+			entry.Stage = stageInsert
+		}
+		if entry.Data.ID.IsZero() {
+			entry.Data.ID = primitive.NewObjectID()
+		}
+		err := o.store.Insert(ctx, entry.Data)
+		if err != nil && !storedDespite(err) {
+			if isRejectedDocument(err) {
+				entry.Stage = stageRejected
+			}
+			return err
+		}
+		reportWriteConcernError(err, 1)
+		o.storeLatest([]SensorData{entry.Data})
+		o.publishAcks([]SensorData{entry.Data})
+		return nil
+	}()
+
+	if err == nil {
+		mongoInserts.Inc()
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": entry.ID}); err != nil {
+			slog.Error("Failed to remove recovered entry", "component", "dlq", "id", entry.ID.Hex(), "error", err)
+		}
+		return true
+	}
+
+	now := time.Now()
+	processErr := newProcessError(entry.Stage, err)
+	processErr.record(1)
+	failure := DeadLetterError{Stage: entry.Stage, Code: processErr.Code, Reason: err.Error(), At: now}
+	if quarantine != nil && entry.Stage != stageRejected && entry.Retries+1 >= o.cfg.DLQMaxRetries {
+		entry.Code, entry.Reason = failure.Code, failure.Reason
+		entry.Retries++
+		entry.LastAttempt = now
+		entry.Errors = append(entry.Errors, failure)
+		if o.quarantine(ctx, entry) {
+			return false
+		}
+	}
+
+	update := bson.M{
+		"$set":  bson.M{"data": entry.Data, "stage": entry.Stage, "code": failure.Code, "reason": failure.Reason, "last_attempt": now},
+		"$inc":  bson.M{"retries": 1},
+		"$push": bson.M{"errors": failure},
+	}
+	if _, uerr := collection.UpdateByID(ctx, entry.ID, update); uerr != nil {
+		slog.Error("Failed to update entry", "component", "dlq", "id", entry.ID.Hex(), "error", uerr)
+	}
+	return false
+}
+
+// quarantine moves entry from the DLQ to QUARANTINE_COLLECTION, keeping its
+// _id. It reports false if the entry could not be moved and stays in the
+// DLQ.
+func (o *Orchestrator) quarantine(ctx context.Context, entry DeadLetter) bool {
+	o.mongoMu.RLock()
+	dlq, quarantine := o.dlqCollection, o.quarantineCollection
+	o.mongoMu.RUnlock()
+
+	entry.QuarantinedAt = entry.LastAttempt
+	// A duplicate _id means an earlier attempt moved it but failed to
+	// remove it from the DLQ.
+	if _, err := quarantine.InsertOne(ctx, entry); err != nil && !mongo.IsDuplicateKeyError(err) {
+		slog.Error("Failed to quarantine entry", "component", "dlq", "id", entry.ID.Hex(), "error", err)
+		return false
+	}
+	if _, err := dlq.DeleteOne(ctx, bson.M{"_id": entry.ID}); err != nil {
+		slog.Error("Failed to remove quarantined entry", "component", "dlq", "id", entry.ID.Hex(), "error", err)
+	}
+	dlqQuarantined.Inc()
+	slog.Warn("Quarantined reading", "component", "dlq", "id", entry.ID.Hex(), "device_id", entry.Data.DeviceID, "message_id", entry.Data.MessageID, "retries", entry.Retries, "reason", entry.Reason)
+	return true
+}
@@ -0,0 +1,81 @@
+// errors.go
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProcessError is the failure of a reading at one stage of the pipeline:
+// "validate", "parse", "encrypt", "insert" or "rejected" (an insert the
+// database refused for good). Code is a short, stable category of the cause,
+// such as "timeout", "circuit_open", "http_503" or "mongo_121", so failures
+// can be counted and alerted on without parsing messages. They are counted
+// in orchestrator_processing_errors_total and kept with dead letters.
+type ProcessError struct {
+	Stage string
+	Code  string
+	Err   error
+}
+
+// Error returns the message of Err; Stage and Code are reported separately.
+func (e *ProcessError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// newProcessError classifies err, which happened at stage.
+func newProcessError(stage string, err error) *ProcessError {
+	return &ProcessError{Stage: stage, Code: errorCode(err), Err: err}
+}
+
+// record counts the failure once for each of the readings it affected.
+func (e *ProcessError) record(readings int) {
+	processingErrors.WithLabelValues(e.Stage, e.Code).Add(float64(readings))
+}
+
+// errorCode returns the category of err for ProcessError.Code, "other" if it
+// has none.
+func errorCode(err error) string {
+	var statusErr *cipherStatusError
+	var writeErr mongo.WriteError
+	var bulkErr mongo.BulkWriteError
+	var commandErr mongo.CommandError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, errInvalidCipherResponse):
+		return "invalid_response"
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("http_%d", statusErr.StatusCode)
+	case mongo.IsDuplicateKeyError(err):
+		return "duplicate_key"
+	case mongo.IsTimeout(err):
+		return "timeout"
+	case mongo.IsNetworkError(err):
+		return "network"
+	case errors.As(err, &writeErr):
+		return fmt.Sprintf("mongo_%d", writeErr.Code)
+	case errors.As(err, &bulkErr):
+		return fmt.Sprintf("mongo_%d", bulkErr.Code)
+	case errors.As(err, &commandErr):
+		return fmt.Sprintf("mongo_%d", commandErr.Code)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
@@ -0,0 +1,54 @@
+// extract.go
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storedFields are the top-level names SensorData already uses; extracted
+// fields must not shadow them.
+var storedFields = map[string]bool{
+	"_id": true, "device_id": true, "payload": true, "payload_json": true,
+	"timestamp": true, "payload_encoding": true, "site": true, "gateway_id": true,
+	"environment": true, "content_type": true, "user_properties": true,
+	"encrypted_fields": true, "message_id": true, "payload_csv": true,
+	"payload_format": true, "mqtt": true, "samples": true, "envelope": true,
+	"field_envelopes": true, "received_at": true,
+}
+
+// parseExtractFields parses EXTRACT_FIELDS, a comma-separated list of
+// top-level payload fields.
+func parseExtractFields(v string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+			continue
+		case storedFields[field]:
+			return nil, fmt.Errorf("%q is a reserved field name", field)
+		case strings.HasPrefix(field, "$") || strings.Contains(field, "."):
+			return nil, fmt.Errorf("%q is not a valid field name", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// extractFields copies the scalar values of fields from a decoded JSON
+// payload. JSON numbers are stored as doubles; objects, arrays and nulls are
+// skipped.
+func extractFields(doc map[string]interface{}, fields []string) map[string]interface{} {
+	var extracted map[string]interface{}
+	for _, field := range fields {
+		switch v := doc[field].(type) {
+		case float64, string, bool:
+			if extracted == nil {
+				extracted = make(map[string]interface{}, len(fields))
+			}
+			extracted[field] = v
+		}
+	}
+	return extracted
+}
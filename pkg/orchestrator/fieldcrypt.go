@@ -0,0 +1,199 @@
+// fieldcrypt.go
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// cipherJob is what has to be encrypted for one reading: the whole payload,
+// or with ENCRYPT_FIELDS the listed fields of a JSON object payload.
+type cipherJob struct {
+	// doc is the decoded payload in field mode, nil for the whole payload.
+	doc    map[string]interface{}
+	fields []string
+	texts  []string
+}
+
+// parseEncryptFields parses ENCRYPT_FIELDS, a comma-separated list of
+// top-level payload fields.
+func parseEncryptFields(v string) []string {
+	var fields []string
+	for _, field := range strings.Split(v, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// parseEncryptTopics parses ENCRYPT_TOPICS, a comma-separated list of MQTT
+// topic filters.
+func parseEncryptTopics(v string) []string {
+	var filters []string
+	for _, filter := range strings.Split(v, ",") {
+		if filter = strings.TrimSpace(filter); filter != "" {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// encrypts reports whether data is to be encrypted: with ENCRYPTION on, all
+// readings unless ENCRYPT_TOPICS is set, then those from a matching topic. A
+// reading whose topic is not known, as from a program embedding the
+// orchestrator, is encrypted.
+func (o *Orchestrator) encrypts(data SensorData) bool {
+	if !o.cfg.Encryption {
+		return false
+	}
+	if len(o.cfg.EncryptTopics) == 0 || data.topic == "" {
+		return true
+	}
+	for _, filter := range o.cfg.EncryptTopics {
+		if topicMatches(filter, data.topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCipherJob works out the texts to encrypt for data. Each field is
+// encrypted as its JSON encoding so that decryption restores its type.
+// Payloads that are not JSON objects are encrypted whole, so nothing is ever
+// stored in plaintext by accident.
+func (o *Orchestrator) newCipherJob(data SensorData) cipherJob {
+	if len(o.cfg.EncryptFields) == 0 || data.PayloadEncoding != "" {
+		return cipherJob{texts: []string{data.Payload}}
+	}
+	doc := parseJSONPayload([]byte(data.Payload))
+	if doc == nil {
+		return cipherJob{texts: []string{data.Payload}}
+	}
+	job := cipherJob{doc: doc}
+	for _, field := range o.cfg.EncryptFields {
+		v, ok := doc[field]
+		if !ok {
+			continue
+		}
+		text, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		job.fields = append(job.fields, field)
+		job.texts = append(job.texts, string(text))
+	}
+	return job
+}
+
+// seal stores the ciphertexts of job, and their envelopes, on data. The
+// parsed plaintext, and extracted copies of encrypted fields, are never
+// stored next to them. Topic template fields come from the topic and are
+// kept.
+func (o *Orchestrator) seal(data SensorData, job cipherJob, ciphertexts []cipherResult) SensorData {
+	if job.doc == nil {
+		data.Payload = ciphertexts[0].Text
+		data.Encrypted = true
+		if env := ciphertexts[0].Envelope; !env.isZero() {
+			data.Envelope = &env
+		}
+		data.PayloadJSON = nil
+		data.PayloadCSV = nil
+		for _, field := range o.cfg.ExtractFields {
+			delete(data.Fields, field)
+		}
+		return data
+	}
+
+	for i, field := range job.fields {
+		job.doc[field] = ciphertexts[i].Text
+		delete(data.Fields, field)
+		if env := ciphertexts[i].Envelope; !env.isZero() {
+			if data.FieldEnvelopes == nil {
+				data.FieldEnvelopes = make(map[string]CipherEnvelope)
+			}
+			data.FieldEnvelopes[field] = env
+		}
+	}
+	if payload, err := json.Marshal(job.doc); err == nil {
+		data.Payload = string(payload)
+	}
+	if data.PayloadJSON != nil {
+		data.PayloadJSON = o.payloadJSON(job.doc)
+	}
+	data.EncryptedFields = job.fields
+	return data
+}
+
+// encryptReading encrypts data field by field or as a whole. On error data
+// is returned unchanged.
+func (o *Orchestrator) encryptReading(ctx context.Context, data SensorData) (SensorData, error) {
+	job := o.newCipherJob(data)
+	ciphertexts := make([]cipherResult, len(job.texts))
+	for i, text := range job.texts {
+		ciphertext, err := o.encryptWithRetry(ctx, text)
+		if err != nil {
+			return data, err
+		}
+		ciphertexts[i] = ciphertext
+	}
+	if len(ciphertexts) == 0 {
+		return data, nil
+	}
+	return o.seal(data, job, ciphertexts), nil
+}
+
+// decryptReading reverses encryptReading for the read-back API.
+func (o *Orchestrator) decryptReading(ctx context.Context, data SensorData) (SensorData, error) {
+	if len(data.EncryptedFields) == 0 {
+		if !data.Encrypted && data.Envelope == nil {
+			// The reading was stored as is, e.g. from a topic outside
+			// ENCRYPT_TOPICS or without any of the ENCRYPT_FIELDS.
+			return data, nil
+		}
+		var env CipherEnvelope
+		if data.Envelope != nil {
+			env = *data.Envelope
+		}
+		plaintext, err := o.callCipher(ctx, "decrypt", data.Payload, env)
+		if err != nil {
+			return data, err
+		}
+		data.Payload = plaintext.Text
+		data.Encrypted = false
+		data.Envelope = nil
+		return data, nil
+	}
+
+	doc := parseJSONPayload([]byte(data.Payload))
+	if doc == nil {
+		return data, errors.New("payload with encrypted fields is not a JSON object")
+	}
+	for _, field := range data.EncryptedFields {
+		ciphertext, ok := doc[field].(string)
+		if !ok {
+			return data, fmt.Errorf("encrypted field %q is not a string", field)
+		}
+		plaintext, err := o.callCipher(ctx, "decrypt", ciphertext, data.FieldEnvelopes[field])
+		if err != nil {
+			return data, err
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(plaintext.Text), &v); err != nil {
+			return data, fmt.Errorf("field %q: %w", field, err)
+		}
+		doc[field] = v
+	}
+	if payload, err := json.Marshal(doc); err == nil {
+		data.Payload = string(payload)
+	}
+	if data.PayloadJSON != nil {
+		data.PayloadJSON = o.payloadJSON(doc)
+	}
+	data.EncryptedFields = nil
+	data.FieldEnvelopes = nil
+	return data, nil
+}
@@ -0,0 +1,48 @@
+// fieldroute.go
+package orchestrator
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// routeValuePattern is what a ROUTE_BY_FIELD value must look like to become
+// part of a collection name. It keeps out the characters MongoDB gives a
+// meaning to ("." and "$"), and anything that could reach another namespace.
+var routeValuePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// parseRouteValues parses ROUTE_ALLOWED_VALUES, the comma-separated values
+// of ROUTE_BY_FIELD that are routed.
+func parseRouteValues(v string) ([]string, error) {
+	var values []string
+	for _, value := range strings.Split(v, ",") {
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			continue
+		case !routeValuePattern.MatchString(value):
+			return nil, fmt.Errorf("%q must be 1 to 64 letters, digits, '_' or '-'", value)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// fieldCollection returns the collection ROUTE_BY_FIELD sends a reading with
+// the decoded payload doc to, or "" when the field is missing, not a string
+// or not a value that may be routed.
+func (o *Orchestrator) fieldCollection(doc map[string]interface{}, deviceID string) string {
+	value, ok := doc[o.cfg.RouteByField].(string)
+	if !ok {
+		return ""
+	}
+	if !routeValuePattern.MatchString(value) || (len(o.cfg.RouteAllowedValues) > 0 && !slices.Contains(o.cfg.RouteAllowedValues, value)) {
+		messagesUnrouted.Inc()
+		slog.Warn("Payload route value not allowed, using the default collection", "component", "mqtt", "device_id", deviceID, "field", o.cfg.RouteByField, "value", value)
+		return ""
+	}
+	return o.cfg.RouteCollectionPrefix + value
+}
@@ -0,0 +1,48 @@
+// flatten.go
+package orchestrator
+
+import (
+	"maps"
+	"slices"
+)
+
+// flattenPayload returns doc with its nested objects replaced by their
+// fields, named by joining the path with sep: {"a":{"b":1}} becomes
+// {"a_b":1}. Arrays are kept as values and empty objects are dropped. When a
+// flattened name is already taken, by a field of an enclosing object or an
+// earlier nested one in name order, the existing field is kept.
+func flattenPayload(doc map[string]interface{}, sep string) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	flat := make(map[string]interface{}, len(doc))
+	flattenInto(flat, "", doc, sep)
+	return flat
+}
+
+func flattenInto(flat map[string]interface{}, prefix string, doc map[string]interface{}, sep string) {
+	// Fields first, so they win over names that nested objects flatten to.
+	names := slices.Sorted(maps.Keys(doc))
+	for _, name := range names {
+		if _, ok := doc[name].(map[string]interface{}); ok {
+			continue
+		}
+		if _, ok := flat[prefix+name]; !ok {
+			flat[prefix+name] = doc[name]
+		}
+	}
+	for _, name := range names {
+		if nested, ok := doc[name].(map[string]interface{}); ok {
+			flattenInto(flat, prefix+name+sep, nested, sep)
+		}
+	}
+}
+
+// payloadJSON returns the payload_json document of doc, flattened with
+// FLATTEN_PAYLOAD. Flattening a flattened document is a no-op.
+func (o *Orchestrator) payloadJSON(doc map[string]interface{}) map[string]interface{} {
+	if !o.cfg.FlattenPayload {
+		return doc
+	}
+	return flattenPayload(doc, o.cfg.FlattenSeparator)
+}
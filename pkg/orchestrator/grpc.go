@@ -0,0 +1,92 @@
+// grpc.go
+package orchestrator
+
+//go:generate protoc -I ingestpb --go_out=ingestpb --go_opt=paths=source_relative --go-grpc_out=ingestpb --go-grpc_opt=paths=source_relative ingest.proto
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rednexx46/orchestrator/pkg/orchestrator/ingestpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ingestServer implements the Ingest service by handing each reading to the
+// same pipeline as MQTT messages.
+type ingestServer struct {
+	ingestpb.UnimplementedIngestServer
+	o *Orchestrator
+}
+
+// startGRPCServer serves the Ingest service on listener, for cfg.GRPCPort,
+// if set.
+func (o *Orchestrator) startGRPCServer(listener net.Listener) {
+	if listener == nil {
+		return
+	}
+	o.grpcServer = grpc.NewServer()
+	ingestpb.RegisterIngestServer(o.grpcServer, ingestServer{o: o})
+	go func() {
+		if err := o.grpcServer.Serve(listener); err != nil {
+			o.failRun(fmt.Errorf("grpc server: %w", err))
+		}
+	}()
+	slog.Info("Listening", "component", "grpc", "port", o.cfg.GRPCPort)
+}
+
+// stopGRPCServer waits for pending Publish calls until ctx is done, then
+// closes their connections.
+func (o *Orchestrator) stopGRPCServer(ctx context.Context) {
+	if o.grpcServer == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		o.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Error("gRPC server shutdown failed", "component", "shutdown", "port", o.cfg.GRPCPort, "error", ctx.Err())
+		o.grpcServer.Stop()
+	}
+}
+
+// Publish handles the reading as a message published on its topic, so
+// MAX_INFLIGHT, WORKERS and every pipeline stage apply to it, and returns
+// once it is stored, dead-lettered or dropped. It fails with Unavailable if
+// the reading could be none of these. A call that gives up first does not
+// withdraw the reading.
+func (s ingestServer) Publish(ctx context.Context, in *ingestpb.SensorData) (*ingestpb.Ack, error) {
+	if in.Topic == "" || strings.ContainsAny(in.Topic, "+#") {
+		return nil, status.Errorf(codes.InvalidArgument, "topic %q is not a valid topic name", in.Topic)
+	}
+
+	// lost is set before handled is closed.
+	var lost error
+	handled := make(chan struct{})
+	s.o.dispatchMessage(Message{
+		Topic:          in.Topic,
+		Payload:        in.Payload,
+		ContentType:    in.ContentType,
+		UserProperties: in.UserProperties,
+		ack:            sync.OnceFunc(func() { close(handled) }),
+		lost:           func(err error) { lost = err },
+	})
+	select {
+	case <-handled:
+		if lost != nil {
+			return nil, status.Errorf(codes.Unavailable, "reading not stored: %v", lost)
+		}
+		return &ingestpb.Ack{}, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
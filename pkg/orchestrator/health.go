@@ -0,0 +1,51 @@
+// health.go
+package orchestrator
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startHealthServer serves /healthz (liveness), /readyz (readiness) and, with
+// ADMIN_TOKEN, /debug/status and /admin/reload on cfg.HealthPort. Readiness requires both the broker and the
+// storage backend to be reachable.
+func (o *Orchestrator) startHealthServer(listener net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		body := map[string]string{"status": "ok", "mqtt": "ok", o.cfg.StorageBackend: "ok"}
+
+		if !o.client.IsConnected() {
+			status = http.StatusServiceUnavailable
+			body["mqtt"] = "disconnected"
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := o.store.Ping(ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			body[o.cfg.StorageBackend] = err.Error()
+		}
+
+		if status != http.StatusOK {
+			body["status"] = "unavailable"
+		}
+		writeJSON(w, status, body)
+	})
+
+	if o.cfg.AdminToken != "" {
+		mux.HandleFunc("GET /debug/status", o.authorizeAdmin(o.handleDebugStatus))
+		mux.HandleFunc("POST /admin/reload", o.authorizeAdmin(o.handleReload))
+	}
+
+	server := &http.Server{Addr: ":" + o.cfg.HealthPort, Handler: mux}
+	o.serve("health", server, listener)
+	slog.Info("Listening", "component", "health", "port", o.cfg.HealthPort)
+	return server
+}
@@ -0,0 +1,143 @@
+// indexes.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureIndexes creates the indexes the orchestrator relies on or was asked
+// for. Creating an index that already exists with the same spec is a no-op.
+func (o *Orchestrator) ensureIndexes() error {
+	if err := o.ensureLatestIndex(); err != nil {
+		return err
+	}
+	if err := o.ensurePresenceIndex(); err != nil {
+		return err
+	}
+	if err := o.ensureRollupIndex(); err != nil {
+		return err
+	}
+	for _, name := range o.dataCollectionNames() {
+		collection := o.dataCollectionFor(name)
+		timeSeries := false
+		if o.cfg.TimeSeries {
+			var err error
+			if timeSeries, err = o.ensureTimeSeriesCollection(name); err != nil {
+				return err
+			}
+		}
+		if timeSeries {
+			if err := o.ensureTimeSeriesExpiry(collection); err != nil {
+				return err
+			}
+		} else if err := o.ensureTTLIndex(collection); err != nil {
+			return err
+		}
+		if !o.cfg.CreateIndexes {
+			continue
+		}
+		if err := ensureQueryIndex(collection); err != nil {
+			return err
+		}
+		fields := slices.Clone(o.cfg.ExtractFields)
+		if o.cfg.TopicTemplate != nil {
+			fields = append(fields, o.cfg.TopicTemplate.fields()...)
+		}
+		for _, field := range fields {
+			if err := ensureFieldIndex(collection, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureQueryIndex creates the {device_id, timestamp} index used by per-device
+// queries.
+func ensureQueryIndex(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("create index on %s: %w", collection.Name(), err)
+	}
+	slog.Info("Ensured index", "component", "mongodb", "collection", collection.Name(), "index", name)
+	return nil
+}
+
+// ensureFieldIndex creates an ascending index on an EXTRACT_FIELDS field for
+// range queries on it.
+func ensureFieldIndex(collection *mongo.Collection, field string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("create index on %s.%s: %w", collection.Name(), field, err)
+	}
+	slog.Info("Ensured index", "component", "mongodb", "collection", collection.Name(), "index", name)
+	return nil
+}
+
+// ensureTTLIndex keeps a TTL index on timestamp matching cfg.DataRetention,
+// recreating an existing timestamp index whose expiry differs.
+func (o *Orchestrator) ensureTTLIndex(collection *mongo.Collection) error {
+	if o.cfg.DataRetention == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	expireAfter := int32(o.cfg.DataRetention / time.Second)
+
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return fmt.Errorf("list indexes of %s: %w", collection.Name(), err)
+	}
+	var indexes []struct {
+		Name        string `bson:"name"`
+		Key         bson.D `bson:"key"`
+		ExpireAfter *int32 `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return fmt.Errorf("list indexes of %s: %w", collection.Name(), err)
+	}
+
+	for _, index := range indexes {
+		if len(index.Key) != 1 || index.Key[0].Key != "timestamp" {
+			continue
+		}
+		if index.ExpireAfter != nil && *index.ExpireAfter == expireAfter {
+			slog.Info("TTL index up to date", "component", "mongodb", "index", index.Name, "expire_after_seconds", expireAfter)
+			return nil
+		}
+		slog.Warn("Recreating timestamp index with new TTL", "component", "mongodb", "index", index.Name, "expire_after_seconds", expireAfter)
+		if _, err := collection.Indexes().DropOne(ctx, index.Name); err != nil {
+			return fmt.Errorf("drop index %s: %w", index.Name, err)
+		}
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(expireAfter),
+	})
+	if err != nil {
+		return fmt.Errorf("create TTL index on %s: %w", collection.Name(), err)
+	}
+	slog.Info("Created TTL index", "component", "mongodb", "collection", collection.Name(), "expire_after_seconds", expireAfter)
+	return nil
+}
@@ -0,0 +1,157 @@
+// ingest.go
+package orchestrator
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxIngestBody caps the size of a POST /ingest request body.
+const maxIngestBody = 10 << 20
+
+// ingestReading is one reading of a POST /ingest request. Payload is stored
+// as its JSON text, or as the string itself when it is a JSON string.
+type ingestReading struct {
+	DeviceID string          `json:"device_id"`
+	Topic    string          `json:"topic"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// startIngestServer serves POST /ingest on listener, for cfg.IngestPort, if
+// set. It returns nil otherwise.
+func (o *Orchestrator) startIngestServer(listener net.Listener) *http.Server {
+	if listener == nil {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ingest", o.handleIngest)
+
+	server := &http.Server{Addr: ":" + o.cfg.IngestPort, Handler: mux}
+	o.serve("ingest", server, listener)
+	slog.Info("Listening", "component", "ingest", "port", o.cfg.IngestPort)
+	return server
+}
+
+// handleIngest accepts a reading, or an array of them, and handles each as
+// a message, so MAX_INFLIGHT, WORKERS and every pipeline stage apply to it.
+// It responds once all of them are stored, dead-lettered or dropped, with
+// 503 if any could be none of these; a client that gives up first does not
+// withdraw them.
+func (o *Orchestrator) handleIngest(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.Header.Get("X-API-Key"))
+	if subtle.ConstantTimeCompare(key, []byte(o.cfg.IngestAPIKey)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxIngestBody)
+	readings, err := decodeIngestReadings(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large"})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var (
+		handled sync.WaitGroup
+		mu      sync.Mutex
+		failed  []int
+		lastErr error
+	)
+	handled.Add(len(readings))
+	for i, reading := range readings {
+		payload := []byte(reading.Payload)
+		var text string
+		if json.Unmarshal(reading.Payload, &text) == nil {
+			payload = []byte(text)
+		}
+		o.dispatchMessage(Message{
+			Topic:    reading.Topic,
+			Payload:  payload,
+			deviceID: reading.DeviceID,
+			ack:      sync.OnceFunc(handled.Done),
+			lost: func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, i)
+				lastErr = err
+			},
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handled.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if len(failed) > 0 {
+			slices.Sort(failed)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"error":    fmt.Sprintf("%d of %d readings not stored: %v", len(failed), len(readings), lastErr),
+				"received": len(readings),
+				"failed":   failed,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"received": len(readings)})
+	case <-r.Context().Done():
+		slog.Warn("Ingest request gone before its readings were handled", "component", "ingest", "readings", len(readings), "error", r.Context().Err())
+	}
+}
+
+// decodeIngestReadings decodes a reading or an array of readings. Every
+// reading needs a device ID and a payload, and a topic, if given, must be a
+// topic name rather than a filter.
+func decodeIngestReadings(body io.Reader) ([]ingestReading, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, errors.New("body must be a JSON object or array of readings")
+	}
+
+	var readings []ingestReading
+	if raw[0] == '[' {
+		if err := json.Unmarshal(raw, &readings); err != nil {
+			return nil, errors.New("body must be a JSON object or array of readings")
+		}
+	} else {
+		var reading ingestReading
+		if err := json.Unmarshal(raw, &reading); err != nil {
+			return nil, errors.New("body must be a JSON object or array of readings")
+		}
+		readings = []ingestReading{reading}
+	}
+	if len(readings) == 0 {
+		return nil, errors.New("no readings given")
+	}
+
+	for i, reading := range readings {
+		switch {
+		case reading.DeviceID == "":
+			return nil, fmt.Errorf("reading %d: device_id is required", i)
+		case len(reading.Payload) == 0 || string(reading.Payload) == "null":
+			return nil, fmt.Errorf("reading %d: payload is required", i)
+		case strings.ContainsAny(reading.Topic, "+#"):
+			return nil, fmt.Errorf("reading %d: topic %q is not a valid topic name", i, reading.Topic)
+		}
+	}
+	return readings, nil
+}
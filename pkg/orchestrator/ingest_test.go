@@ -0,0 +1,59 @@
+// ingest_test.go
+package orchestrator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeIngestReadings(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		devices  []string
+		payloads []string
+		wantErr  string
+	}{
+		{
+			name:     "single reading",
+			body:     `{"device_id":"a","topic":"mesh/data/a","payload":{"t":1}}`,
+			devices:  []string{"a"},
+			payloads: []string{`{"t":1}`},
+		},
+		{
+			name:     "array",
+			body:     `[{"device_id":"a","payload":1},{"device_id":"b","payload":"text"}]`,
+			devices:  []string{"a", "b"},
+			payloads: []string{`1`, `"text"`},
+		},
+		{name: "not JSON", body: `device_id=a`, wantErr: "body must be"},
+		{name: "wrong type", body: `"a"`, wantErr: "body must be"},
+		{name: "empty array", body: `[]`, wantErr: "no readings given"},
+		{name: "missing device", body: `{"payload":1}`, wantErr: "reading 0: device_id is required"},
+		{name: "missing payload", body: `[{"device_id":"a","payload":1},{"device_id":"b"}]`, wantErr: "reading 1: payload is required"},
+		{name: "null payload", body: `{"device_id":"a","payload":null}`, wantErr: "payload is required"},
+		{name: "wildcard topic", body: `{"device_id":"a","topic":"mesh/+/a","payload":1}`, wantErr: "not a valid topic name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings, err := decodeIngestReadings(strings.NewReader(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if len(readings) != len(tt.devices) {
+				t.Fatalf("got %d readings, want %d", len(readings), len(tt.devices))
+			}
+			for i, reading := range readings {
+				if reading.DeviceID != tt.devices[i] || string(reading.Payload) != tt.payloads[i] {
+					t.Errorf("reading %d = %s %s, want %s %s", i, reading.DeviceID, reading.Payload, tt.devices[i], tt.payloads[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// kafka.go
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaStore publishes readings as JSON to KAFKA_TOPIC, keyed by device ID so
+// that the readings of a device stay in order on one partition. It runs as a
+// mirror of the storage backend; see teeStore.
+type kafkaStore struct {
+	brokers []string
+	writer  *kafka.Writer
+}
+
+func newKafkaStore(brokers []string, topic string) *kafkaStore {
+	return &kafkaStore{
+		brokers: brokers,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// The readings are already stored, so the batch writer does not
+			// wait for Kafka; failures are reported by the completion.
+			Async:        true,
+			BatchTimeout: 100 * time.Millisecond,
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					kafkaMessages.WithLabelValues("error").Add(float64(len(messages)))
+					slog.Error("Kafka publish failed", "component", "kafka", "topic", topic, "messages", len(messages), "error", err)
+					return
+				}
+				kafkaMessages.WithLabelValues("ok").Add(float64(len(messages)))
+			},
+		},
+	}
+}
+
+func (s *kafkaStore) Insert(ctx context.Context, data SensorData) error {
+	return s.InsertMany(ctx, []SensorData{data})
+}
+
+// InsertMany queues the readings for the writer. It waits for the brokers
+// only to look up the partitions of the topic.
+func (s *kafkaStore) InsertMany(ctx context.Context, batch []SensorData) error {
+	messages := make([]kafka.Message, 0, len(batch))
+	for _, data := range batch {
+		value, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{Key: []byte(data.DeviceID), Value: value, Time: data.Timestamp})
+	}
+	if err := s.writer.WriteMessages(ctx, messages...); err != nil {
+		kafkaMessages.WithLabelValues("error").Add(float64(len(messages)))
+		return err
+	}
+	return nil
+}
+
+// Ping reports whether any of the brokers accepts a connection.
+func (s *kafkaStore) Ping(ctx context.Context) error {
+	var errs []error
+	for _, broker := range s.brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn.Close()
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Close publishes the queued readings, giving up on them once ctx is done.
+func (s *kafkaStore) Close(ctx context.Context) error {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.writer.Close()
+	}()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,97 @@
+// latest.go
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureLatestIndex creates the unique device_id index the latest-state
+// upsert relies on to avoid inserting a second document per device.
+func (o *Orchestrator) ensureLatestIndex() error {
+	o.mongoMu.RLock()
+	collection := o.latestCollection
+	o.mongoMu.RUnlock()
+
+	if collection == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "device_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("create index on %s: %w", collection.Name(), err)
+	}
+	slog.Info("Tracking latest readings", "component", "mongodb", "collection", collection.Name())
+	return nil
+}
+
+// storeLatest replaces the last-known reading of each device in batch, which
+// is already stored, with the newest one there, but only where that is newer
+// than the one in the collection. It is a single bulk write under workCtx,
+// like the batch insert.
+func (o *Orchestrator) storeLatest(batch []SensorData) {
+	o.mongoMu.RLock()
+	collection := o.latestCollection
+	o.mongoMu.RUnlock()
+
+	if collection == nil || len(batch) == 0 {
+		return
+	}
+
+	newest := make(map[string]SensorData, len(batch))
+	for _, data := range batch {
+		if current, ok := newest[data.DeviceID]; !ok || data.Timestamp.After(current.Timestamp) {
+			newest[data.DeviceID] = data
+		}
+	}
+	readings := make([]SensorData, 0, len(newest))
+	models := make([]mongo.WriteModel, 0, len(newest))
+	for _, data := range newest {
+		// The latest-state document keeps its own _id.
+		data.ID = primitive.NilObjectID
+		readings = append(readings, data)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"device_id": data.DeviceID, "timestamp": bson.M{"$lt": data.Timestamp}}).
+			SetReplacement(data).
+			SetUpsert(true))
+	}
+
+	ctx, cancel := context.WithTimeout(o.workCtx, o.cfg.MongoInsertTimeout)
+	defer cancel()
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) {
+		if err != nil {
+			slog.Error("Latest-state update failed", "component", "mongodb", "devices", len(models), "error", err)
+		}
+		return
+	}
+	for _, we := range bwe.WriteErrors {
+		if mongo.IsDuplicateKeyError(we) {
+			// The filter did not match because the stored reading is
+			// newer, so the upsert tried to insert a second document for
+			// the device.
+			continue
+		}
+		data := readings[we.Index]
+		slog.Error("Latest-state update failed", "component", "mongodb", "device_id", data.DeviceID, "message_id", data.MessageID, "error", we.Message)
+	}
+	if bwe.WriteConcernError != nil {
+		slog.Error("Latest-state update failed", "component", "mongodb", "devices", len(models), "error", bwe.WriteConcernError.Message)
+	}
+}
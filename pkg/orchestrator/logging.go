@@ -0,0 +1,24 @@
+// logging.go
+package orchestrator
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logLevel is the level of the default logger, which POST /admin/reload can
+// change.
+var logLevel = new(slog.LevelVar)
+
+// SetupLogging installs the default slog logger for cfg.LogLevel and
+// cfg.LogFormat. Programs embedding the orchestrator may install their own
+// logger instead; POST /admin/reload then cannot change the level.
+func SetupLogging(cfg Config) {
+	logLevel.Set(cfg.LogLevel)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
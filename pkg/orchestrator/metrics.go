@@ -0,0 +1,121 @@
+// metrics.go
+package orchestrator
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_messages_received_total",
+		Help: "MQTT messages received, by topic.",
+	}, []string{"topic"})
+
+	messagesDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_messages_duplicate_total",
+		Help: "MQTT messages skipped as duplicates within DEDUP_WINDOW.",
+	})
+
+	messagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_messages_dropped_total",
+		Help: "MQTT messages dropped before storage, by reason.",
+	}, []string{"reason"})
+
+	messagesUnrouted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_messages_unrouted_total",
+		Help: "Readings whose ROUTE_BY_FIELD value was not allowed, stored in the default collection.",
+	})
+
+	messagesInvalidUTF8 = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_messages_invalid_utf8_total",
+		Help: "MQTT payloads that were not valid UTF-8 and were stored base64-encoded.",
+	})
+
+	workQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "orchestrator_work_queue_length",
+		Help: "Messages waiting for a worker.",
+	})
+
+	inflightMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "orchestrator_inflight_messages",
+		Help: "Messages holding a MAX_INFLIGHT slot.",
+	})
+
+	subscriptionGrantedQoS = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "orchestrator_subscription_granted_qos",
+		Help: "QoS the broker granted each topic filter subscription.",
+	}, []string{"topic"})
+
+	subscriptionDowngrades = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_subscription_downgrades_total",
+		Help: "Subscriptions the broker granted a lower QoS than requested, by topic filter.",
+	}, []string{"topic"})
+
+	mongoInserts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_mongo_inserts_total",
+		Help: "Documents successfully inserted into MongoDB.",
+	})
+
+	mongoInsertFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_mongo_insert_failures_total",
+		Help: "Documents that failed to be inserted into MongoDB.",
+	})
+
+	mongoWriteConcernErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_mongo_write_concern_errors_total",
+		Help: "Documents written to the primary whose write concern was not satisfied.",
+	})
+
+	mongoInsertLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "orchestrator_mongo_insert_duration_seconds",
+		Help:    "Latency of MongoDB batch inserts.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	kafkaMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_kafka_messages_total",
+		Help: "Readings published to KAFKA_TOPIC, by result.",
+	}, []string{"result"})
+
+	processingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_processing_errors_total",
+		Help: "Readings that failed at a pipeline stage, by stage and error code.",
+	}, []string{"stage", "code"})
+
+	dlqQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_dlq_quarantined_total",
+		Help: "Dead letters moved to QUARANTINE_COLLECTION after DLQ_MAX_RETRIES failed retries.",
+	})
+
+	cipherRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orchestrator_cipher_requests_total",
+		Help: "Calls to the cipher API, by result.",
+	}, []string{"result"})
+
+	cipherInvalidResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orchestrator_cipher_invalid_responses_total",
+		Help: "Cipher API 200 responses that were malformed or lacked a ciphertext.",
+	})
+
+	cipherBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "orchestrator_cipher_breaker_state",
+		Help: "Cipher API circuit breaker state: 0 closed, 1 open, 2 half-open.",
+	})
+)
+
+// startMetricsServer serves Prometheus metrics on cfg.MetricsPort.
+func (o *Orchestrator) startMetricsServer(listener net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: ":" + o.cfg.MetricsPort, Handler: mux}
+	o.serve("metrics", server, listener)
+	slog.Info("Listening", "component", "metrics", "port", o.cfg.MetricsPort)
+	return server
+}
@@ -0,0 +1,380 @@
+// mongo.go
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// connectMongo connects to MongoDB (MONGO_URI, or a URI built from the host
+// settings), retrying with exponential backoff until the server answers a
+// ping. It returns ctx.Err() if ctx is done first.
+func (o *Orchestrator) connectMongo(ctx context.Context) error {
+	uri := o.cfg.MongoURI
+	if uri == "" {
+		u := &url.URL{Scheme: "mongodb", Host: net.JoinHostPort(o.cfg.MongoHost, o.cfg.MongoPort)}
+		if o.cfg.MongoUser != "" {
+			// UserPassword escapes characters such as @, : and / that would
+			// otherwise end the user info.
+			u.User = url.UserPassword(o.cfg.MongoUser, o.cfg.MongoPass)
+		}
+		uri = u.String()
+	}
+	o.mongoClientOpts = options.Client().
+		ApplyURI(uri).
+		SetWriteConcern(o.cfg.MongoWriteConcern).
+		SetConnectTimeout(o.cfg.MongoConnectTimeout).
+		SetMaxPoolSize(o.cfg.MongoMaxPool).
+		SetMinPoolSize(o.cfg.MongoMinPool).
+		// payload_json may be any JSON value, so it is decoded into an
+		// interface{}; documents must then come back as maps, not bson.D,
+		// for the read-back API to return them as JSON objects.
+		SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true})
+
+	return o.reconnectMongo(ctx)
+}
+
+// reconnectMongo dials MongoDB until it succeeds and swaps in the new client,
+// or until ctx is done.
+func (o *Orchestrator) reconnectMongo(ctx context.Context) error {
+	delay := o.cfg.MongoRetryBase
+	for attempt := 1; ; attempt++ {
+		client, err := o.dialMongo(ctx)
+		if err == nil {
+			o.useMongoClient(client)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		slog.Warn("Connection attempt failed", "component", "mongodb", "attempt", attempt, "retry_in", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > o.cfg.MongoRetryMax {
+			delay = o.cfg.MongoRetryMax
+		}
+	}
+}
+
+// useMongoClient makes client the active connection and returns the one it
+// replaced, if any.
+func (o *Orchestrator) useMongoClient(client *mongo.Client) *mongo.Client {
+	db := client.Database(o.cfg.MongoDatabase)
+
+	o.mongoMu.Lock()
+	old := o.mongoClient
+	o.mongoClient = client
+	o.mongoDatabase = db
+	o.dataCollection = db.Collection(o.cfg.MongoCollection, o.dataCollectionOptions())
+	if o.cfg.LatestCollection != "" {
+		o.latestCollection = db.Collection(o.cfg.LatestCollection, o.dataCollectionOptions())
+	}
+	if o.cfg.DLQCollection != "" {
+		o.dlqCollection = db.Collection(o.cfg.DLQCollection)
+	}
+	if o.cfg.DLQMaxRetries > 0 {
+		o.quarantineCollection = db.Collection(o.cfg.QuarantineCollection)
+	}
+	if o.cfg.PresenceCollection != "" {
+		o.presenceCollection = db.Collection(o.cfg.PresenceCollection)
+	}
+	if o.cfg.RollupInterval != 0 {
+		o.rollupCollection = db.Collection(o.cfg.RollupCollection)
+	}
+	o.mongoMu.Unlock()
+
+	slog.Info("Connected", "component", "mongodb", "database", o.cfg.MongoDatabase, "collection", o.cfg.MongoCollection)
+	return old
+}
+
+// dataCollectionFor returns the collection readings routed to name are stored
+// in; an empty name is MONGO_COLLECTION. It is nil before the first connect.
+func (o *Orchestrator) dataCollectionFor(name string) *mongo.Collection {
+	o.mongoMu.RLock()
+	defer o.mongoMu.RUnlock()
+
+	if name == "" || name == o.cfg.MongoCollection || o.mongoDatabase == nil {
+		return o.dataCollection
+	}
+	return o.mongoDatabase.Collection(name, o.dataCollectionOptions())
+}
+
+// dataCollectionNames lists MONGO_COLLECTION, every TOPIC_COLLECTION_MAP
+// target, the ROUTE_ALLOWED_VALUES collections and STALE_COLLECTION, without
+// duplicates.
+func (o *Orchestrator) dataCollectionNames() []string {
+	names := []string{o.cfg.MongoCollection}
+	seen := map[string]bool{o.cfg.MongoCollection: true}
+	for _, route := range o.cfg.CollectionRoutes {
+		if !seen[route.Collection] {
+			seen[route.Collection] = true
+			names = append(names, route.Collection)
+		}
+	}
+	for _, value := range o.cfg.RouteAllowedValues {
+		if name := o.cfg.RouteCollectionPrefix + value; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if o.cfg.StaleCollection != "" && !seen[o.cfg.StaleCollection] {
+		names = append(names, o.cfg.StaleCollection)
+	}
+	return names
+}
+
+// routedCollectionNames lists the existing collections named with
+// ROUTE_COLLECTION_PREFIX when ROUTE_BY_FIELD has no ROUTE_ALLOWED_VALUES, so
+// any safe value may have created one that dataCollectionNames cannot know.
+func (o *Orchestrator) routedCollectionNames(ctx context.Context) ([]string, error) {
+	if o.cfg.RouteByField == "" || len(o.cfg.RouteAllowedValues) > 0 || o.cfg.RouteCollectionPrefix == "" {
+		return nil, nil
+	}
+	o.mongoMu.RLock()
+	db := o.mongoDatabase
+	o.mongoMu.RUnlock()
+	if db == nil {
+		return nil, nil
+	}
+	return db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(o.cfg.RouteCollectionPrefix)}})
+}
+
+func (o *Orchestrator) dialMongo(ctx context.Context) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.cfg.MongoConnectTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, o.mongoClientOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return client, nil
+}
+
+// ensureMongoConnected pings the server and, if it does not answer, makes a
+// single reconnect attempt. Callers fall back to the disk buffer or the DLQ
+// when it fails rather than blocking until MongoDB is back.
+func (o *Orchestrator) ensureMongoConnected() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := o.pingMongo(ctx); err == nil {
+		return nil
+	}
+
+	slog.Warn("Connection lost, reconnecting", "component", "mongodb")
+	client, err := o.dialMongo(context.Background())
+	if err != nil {
+		return err
+	}
+	if old := o.useMongoClient(client); old != nil {
+		old.Disconnect(ctx)
+	}
+	return nil
+}
+
+func (o *Orchestrator) pingMongo(ctx context.Context) error {
+	o.mongoMu.RLock()
+	client := o.mongoClient
+	o.mongoMu.RUnlock()
+
+	if client == nil {
+		return errors.New("not connected")
+	}
+	return client.Ping(ctx, nil)
+}
+
+func (o *Orchestrator) disconnectMongo(ctx context.Context) error {
+	o.mongoMu.RLock()
+	client := o.mongoClient
+	o.mongoMu.RUnlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
+
+// transientMongoCodes are server error codes for failures that may succeed
+// when retried.
+var transientMongoCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+}
+
+// isTransientMongoError reports whether err is worth retrying. Anything else,
+// such as a duplicate key or a document failing collection validation, fails
+// the same way every time.
+func isTransientMongoError(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") || se.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range transientMongoCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDuplicateIDError reports a duplicate key on _id. IDs are assigned before
+// the first attempt, so this means an earlier attempt did store the document.
+func isDuplicateIDError(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCodeWithMessage(11000, "index: _id_ ")
+}
+
+// storedDespite reports whether every document of a failed insert is stored
+// anyway: the only errors are duplicate _ids, written by an earlier attempt,
+// and a write concern error.
+func storedDespite(err error) bool {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		for _, we := range bwe.WriteErrors {
+			if !isDuplicateIDError(we) {
+				return false
+			}
+		}
+		return true
+	}
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if !isDuplicateIDError(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// storedReadings returns the readings of batch that an insert failing with
+// err stored nonetheless: all of them when storedDespite, otherwise those the
+// bulk write did not report an error for.
+func storedReadings(batch []SensorData, err error) []SensorData {
+	if err == nil || storedDespite(err) {
+		return batch
+	}
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) {
+		return nil
+	}
+	failed := make(map[int]bool, len(bwe.WriteErrors))
+	for _, we := range bwe.WriteErrors {
+		if !isDuplicateIDError(we) {
+			failed[we.Index] = true
+		}
+	}
+	var stored []SensorData
+	for i, data := range batch {
+		if !failed[i] {
+			stored = append(stored, data)
+		}
+	}
+	return stored
+}
+
+// reportWriteConcernError logs a write concern error in err, if any. Such an
+// error means the write reached the primary but was not acknowledged by
+// enough members in time (MONGO_WTIMEOUT), typically while the replica set is
+// degraded. Retrying would not undo the write, so the documents count as
+// stored; they are only at risk if the primary rolls back.
+func reportWriteConcernError(err error, documents int) {
+	var wce *mongo.WriteConcernError
+	var bwe mongo.BulkWriteException
+	var we mongo.WriteException
+	switch {
+	case errors.As(err, &bwe):
+		wce = bwe.WriteConcernError
+	case errors.As(err, &we):
+		wce = we.WriteConcernError
+	}
+	if wce == nil {
+		return
+	}
+	mongoWriteConcernErrors.Add(float64(documents))
+	slog.Warn("Write not acknowledged by the write concern", "component", "mongodb", "documents", documents, "code", wce.Code, "error", wce.Message)
+}
+
+// isRejectedDocument reports a write error on the document itself that will
+// not go away on retry. Errors affecting the whole operation (such as a
+// missing privilege) may be fixed and are not included.
+func isRejectedDocument(err error) bool {
+	var we mongo.WriteException
+	return errors.As(err, &we) && len(we.WriteErrors) > 0 && !isTransientMongoError(err)
+}
+
+// mongoStore is the default Store, writing to the data collections.
+type mongoStore struct {
+	o *Orchestrator
+}
+
+func (s *mongoStore) Insert(ctx context.Context, data SensorData) error {
+	_, err := s.o.dataCollectionFor(data.Collection).InsertOne(ctx, data)
+	return err
+}
+
+// InsertMany inserts batch into the collection of its readings, which
+// groupByCollection makes the same for all of them. A mixed batch, such as
+// fresh and STALE_ACTION=archive readings, is refused rather than stored in
+// the first reading's collection.
+func (s *mongoStore) InsertMany(ctx context.Context, batch []SensorData) error {
+	docs := make([]interface{}, len(batch))
+	for i, data := range batch {
+		if data.Collection != batch[0].Collection {
+			return fmt.Errorf("batch mixes collections %q and %q", batch[0].Collection, data.Collection)
+		}
+		docs[i] = data
+	}
+	collection := s.o.dataCollectionFor(batch[0].Collection)
+
+	// Unordered so that a single bad document does not stop the rest of the
+	// batch from being written.
+	_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+func (s *mongoStore) Ping(ctx context.Context) error {
+	return s.o.pingMongo(ctx)
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.o.disconnectMongo(ctx)
+}
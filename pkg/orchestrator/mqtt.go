@@ -0,0 +1,557 @@
+// mqtt.go
+package orchestrator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerClient is the part of the MQTT client the rest of the orchestrator
+// uses, so the v3.1.1 and v5 clients are interchangeable.
+type brokerClient interface {
+	Connect(ctx context.Context) error
+	IsConnected() bool
+	Publish(topic string, qos byte, retained bool, payload string) error
+	// Subscribe returns the QoS the broker granted each of subs, in order,
+	// or 0x80 for a rejected subscription.
+	Subscribe(subs []subscription) ([]byte, error)
+	Unsubscribe(filters []string) error
+	Disconnect()
+}
+
+// Message is a received publish, independent of the protocol version.
+// ContentType and UserProperties are only set by MQTT v5 brokers.
+type Message struct {
+	Topic          string
+	Payload        []byte
+	ContentType    string
+	UserProperties map[string]string
+	Meta           MQTTMeta
+	// deviceID, when set, is used instead of the device ID derived from
+	// Topic, for readings that name their device (POST /ingest).
+	deviceID string
+	// ack acknowledges the publish to the broker with MANUAL_ACK, and is
+	// nil otherwise.
+	ack func()
+	// lost, when set, is told why the reading could be neither stored,
+	// buffered nor dead-lettered, before ack is called.
+	lost func(error)
+}
+
+// MQTTMeta is the delivery information of a publish, stored with
+// STORE_MQTT_META.
+type MQTTMeta struct {
+	Retained  bool `json:"retained" bson:"retained"`
+	QoS       byte `json:"qos" bson:"qos"`
+	Duplicate bool `json:"duplicate" bson:"duplicate"`
+	// PacketID is the MQTT packet identifier, 0 for QoS 0. The broker
+	// reuses identifiers, so it only identifies a delivery in progress.
+	PacketID uint16 `json:"packet_id" bson:"packet_id"`
+}
+
+// newBrokerClient returns the client for the configured MQTT_VERSION.
+func (o *Orchestrator) newBrokerClient() (brokerClient, error) {
+	tlsConfig, err := o.mqttTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if o.cfg.MQTTVersion == 5 {
+		return o.newMQTTv5Client(tlsConfig)
+	}
+	return mqttV3Client{mqtt.NewClient(o.mqttClientOptions(tlsConfig))}, nil
+}
+
+// mqttV3Client adapts the paho.mqtt.golang client to brokerClient.
+type mqttV3Client struct {
+	mqtt.Client
+}
+
+// Connect blocks until a broker accepts the connection or ctx is done.
+func (c mqttV3Client) Connect(ctx context.Context) error {
+	token := c.Client.Connect()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c mqttV3Client) Publish(topic string, qos byte, retained bool, payload string) error {
+	token := c.Client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errors.New("publish timed out")
+	}
+	return token.Error()
+}
+
+// Subscribe adds subscriptions on the current connection. Their messages go
+// to the default publish handler.
+func (c mqttV3Client) Subscribe(subs []subscription) ([]byte, error) {
+	token := c.Client.SubscribeMultiple(subscribeFilters(subs), nil)
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, errors.New("subscribe timed out")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return grantedQoS(token, subs), nil
+}
+
+func subscribeFilters(subs []subscription) map[string]byte {
+	filters := make(map[string]byte, len(subs))
+	for _, sub := range subs {
+		filters[sub.Filter] = sub.QoS
+	}
+	return filters
+}
+
+// grantedQoS returns the QoS granted to each of subs by a completed
+// subscribe token, 0x80 where the broker rejected the subscription.
+func grantedQoS(token mqtt.Token, subs []subscription) []byte {
+	result := token.(*mqtt.SubscribeToken).Result()
+	granted := make([]byte, len(subs))
+	for i, sub := range subs {
+		qos, ok := result[sub.Filter]
+		if !ok {
+			qos = 0x80
+		}
+		granted[i] = qos
+	}
+	return granted
+}
+
+func (c mqttV3Client) Unsubscribe(filters []string) error {
+	token := c.Client.Unsubscribe(filters...)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("unsubscribe timed out")
+	}
+	return token.Error()
+}
+
+func (c mqttV3Client) Disconnect() {
+	c.Client.Disconnect(250)
+}
+
+// mqttClientOptions builds the broker connection options from cfg. The
+// OnConnect handler (re)subscribes to every configured topic filter.
+func (o *Orchestrator) mqttClientOptions(tlsConfig *tls.Config) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		SetClientID(o.cfg.MQTTClientID).
+		// With QoS 1/2 the broker must keep our subscriptions and queued
+		// messages across reconnects, which requires a persistent session.
+		SetCleanSession(!o.cfg.MQTTPersistentSession).
+		// Keep trying the brokers in turn until one accepts the connection,
+		// and reconnect (resubscribing in OnConnect) whenever it drops.
+		SetConnectRetry(true).
+		SetConnectRetryInterval(o.cfg.MQTTConnectRetry).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(o.cfg.MQTTMaxReconnect).
+		// With MANUAL_ACK a publish is acknowledged once its reading is
+		// stored, not when the handler returns.
+		SetAutoAckDisabled(o.cfg.ManualAck)
+	for _, broker := range o.cfg.MQTTBrokers {
+		opts.AddBroker(o.brokerURL("tcp", "ssl", broker))
+	}
+	if o.cfg.MQTTStoreDir != "" {
+		// Unacknowledged QoS 1/2 packets are kept on disk, so a QoS 2
+		// handshake interrupted by a restart is completed, not repeated.
+		opts.SetStore(mqtt.NewFileStore(o.cfg.MQTTStoreDir))
+	}
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if o.cfg.MQTTUsername != "" {
+		opts.SetUsername(o.cfg.MQTTUsername)
+	}
+	if o.cfg.MQTTPassword != "" {
+		opts.SetPassword(o.cfg.MQTTPassword)
+	}
+
+	if o.cfg.LWTTopic != "" {
+		opts.SetWill(o.cfg.LWTTopic, o.cfg.LWTPayload, o.cfg.LWTQoS, o.cfg.LWTRetained)
+	}
+
+	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
+		slog.Warn("Connection lost, reconnecting", "component", "mqtt", "error", err)
+	}
+	opts.OnReconnecting = func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		slog.Info("Reconnecting to broker", "component", "mqtt")
+	}
+	// Every subscription uses the default handler, so filters added by a
+	// reload need no handler of their own.
+	opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+		in := Message{
+			Topic:   msg.Topic(),
+			Payload: msg.Payload(),
+			Meta: MQTTMeta{
+				Retained:  msg.Retained(),
+				QoS:       msg.Qos(),
+				Duplicate: msg.Duplicate(),
+				PacketID:  msg.MessageID(),
+			},
+		}
+		if o.cfg.ManualAck {
+			in.ack = msg.Ack
+		}
+		o.dispatchMessage(in)
+	})
+	opts.OnConnect = func(c mqtt.Client) {
+		slog.Info("Connected to broker", "component", "mqtt")
+		o.publishStatus(mqttV3Client{c}, o.cfg.OnlinePayload)
+		subs := o.brokerSubscriptions(o.subscriptions())
+		for _, sub := range subs {
+			slog.Info("Subscribing", "component", "mqtt", "topic", sub.Filter, "qos", sub.QoS)
+		}
+		token := c.SubscribeMultiple(subscribeFilters(subs), nil)
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			err = o.checkGrantedQoS(subs, grantedQoS(token, subs))
+		}
+		if err != nil {
+			o.failRun(fmt.Errorf("subscribe: %w", err))
+		}
+	}
+	return opts
+}
+
+// brokerURL returns the URL of broker for MQTT_TRANSPORT, using the client
+// library's schemes for plain and TLS connections over TCP.
+func (o *Orchestrator) brokerURL(plain, secure, broker string) string {
+	switch o.cfg.MQTTTransport {
+	case "ws", "wss":
+		return o.cfg.MQTTTransport + "://" + broker + o.cfg.MQTTWSPath
+	}
+	if o.cfg.MQTTTLS {
+		return secure + "://" + broker
+	}
+	return plain + "://" + broker
+}
+
+// publishStatus publishes payload to the LWT topic, if one is configured.
+func (o *Orchestrator) publishStatus(c brokerClient, payload string) {
+	if o.cfg.LWTTopic == "" {
+		return
+	}
+	if err := c.Publish(o.cfg.LWTTopic, o.cfg.LWTQoS, o.cfg.LWTRetained, payload); err != nil {
+		slog.Warn("Status publish failed", "component", "mqtt", "topic", o.cfg.LWTTopic, "error", err)
+	}
+}
+
+// mqttTLSConfig builds the TLS configuration for the broker connection. It
+// returns nil when TLS is off.
+func (o *Orchestrator) mqttTLSConfig() (*tls.Config, error) {
+	if !o.cfg.MQTTTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: o.cfg.MQTTTLSInsecure,
+	}
+
+	if o.cfg.MQTTCACert != "" {
+		caPEM, err := os.ReadFile(o.cfg.MQTTCACert)
+		if err != nil {
+			return nil, fmt.Errorf("read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in %s", o.cfg.MQTTCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.cfg.MQTTClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.cfg.MQTTClientCert, o.cfg.MQTTClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled", "component", "mqtt")
+	}
+	return tlsConfig, nil
+}
+
+// subscription is a topic filter the orchestrator subscribes to.
+type subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// acknowledge confirms the message that produced data to the broker. It is a
+// no-op without MANUAL_ACK and for readings not received over MQTT (DLQ and
+// buffer retries).
+func (data SensorData) acknowledge() {
+	if data.ack != nil {
+		data.ack()
+	}
+}
+
+// acknowledgeAll acknowledges the messages of every reading in batch.
+func acknowledgeAll(batch []SensorData) {
+	for _, data := range batch {
+		data.acknowledge()
+	}
+}
+
+// fail reports err to the source of the message that produced data, for a
+// reading that could be neither stored, buffered nor dead-lettered, and lets
+// the deduplicator accept the message again. It does not acknowledge the
+// message.
+func (data SensorData) fail(err error) {
+	if data.forget != nil {
+		data.forget()
+	}
+	if data.lost != nil {
+		data.lost(err)
+	}
+}
+
+// failAll reports err for every reading in batch and acknowledges their
+// messages.
+func failAll(batch []SensorData, err error) {
+	for _, data := range batch {
+		data.fail(err)
+		data.acknowledge()
+	}
+}
+
+// subscriptions returns the topic filters currently subscribed to: those of
+// MQTT_TOPICS, or of the last reload.
+func (o *Orchestrator) subscriptions() []subscription {
+	o.subsMu.RLock()
+	defer o.subsMu.RUnlock()
+	return o.subs
+}
+
+// brokerSubscriptions returns subs as subscribed at the broker: with
+// MQTT_SHARED_GROUP, as $share/{group}/{filter}. Published topics never
+// carry the prefix, so everything else matches against the plain filters.
+func (o *Orchestrator) brokerSubscriptions(subs []subscription) []subscription {
+	if o.cfg.MQTTSharedGroup == "" {
+		return subs
+	}
+	shared := make([]subscription, len(subs))
+	for i, sub := range subs {
+		shared[i] = subscription{Filter: o.brokerFilter(sub.Filter), QoS: sub.QoS}
+	}
+	return shared
+}
+
+func (o *Orchestrator) brokerFilter(filter string) string {
+	if o.cfg.MQTTSharedGroup == "" {
+		return filter
+	}
+	return "$share/" + o.cfg.MQTTSharedGroup + "/" + filter
+}
+
+// parseSubscriptions parses a comma-separated topic list such as
+// "mesh/data/#:1,alerts/#". Entries without a ":qos" suffix use defaultQoS.
+func parseSubscriptions(list string, defaultQoS byte) ([]subscription, error) {
+	var subs []subscription
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		sub := subscription{Filter: entry, QoS: defaultQoS}
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			qos, err := parseQoS(entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("topic %q: %w", entry, err)
+			}
+			sub.Filter, sub.QoS = entry[:i], qos
+		}
+		if sub.Filter == "" {
+			return nil, fmt.Errorf("topic %q: empty filter", entry)
+		}
+		subs = append(subs, sub)
+	}
+	if len(subs) == 0 {
+		return nil, errors.New("no topics given")
+	}
+	return subs, nil
+}
+
+func parseQoS(v string) (byte, error) {
+	switch v {
+	case "0", "1", "2":
+		return v[0] - '0', nil
+	}
+	return 0, fmt.Errorf("invalid QoS %q (must be 0, 1 or 2)", v)
+}
+
+// collectionRoute sends readings from topics matching Filter to Collection.
+type collectionRoute struct {
+	Filter     string
+	Collection string
+}
+
+// parseCollectionRoutes parses a JSON object such as
+// {"mesh/data/#": "raw", "alerts/#": "alerts"}, keeping the order of its keys
+// since the first matching filter wins.
+func parseCollectionRoutes(v string) ([]collectionRoute, error) {
+	dec := json.NewDecoder(strings.NewReader(v))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("must be a JSON object of topic filter to collection")
+	}
+	var routes []collectionRoute
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var collection string
+		if err := dec.Decode(&collection); err != nil {
+			return nil, fmt.Errorf("filter %q: collection must be a string", tok)
+		}
+		if collection == "" {
+			return nil, fmt.Errorf("filter %q: empty collection", tok)
+		}
+		routes = append(routes, collectionRoute{Filter: tok.(string), Collection: collection})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// routeCollection returns the collection of the first route matching topic,
+// or "" for the default collection.
+func (o *Orchestrator) routeCollection(topic string) string {
+	for _, route := range o.cfg.CollectionRoutes {
+		if topicMatches(route.Filter, topic) {
+			return route.Collection
+		}
+	}
+	return ""
+}
+
+// topicMatches reports whether topic matches the MQTT topic filter.
+func topicMatches(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+// deviceIDFromTopic derives the device ID from the subscription that matched
+// topic: the segment matched by the filter's last "+" wildcard, or the last
+// topic segment for "#" filters and exact topics.
+func (o *Orchestrator) deviceIDFromTopic(topic string) string {
+	topicParts := strings.Split(topic, "/")
+	for _, sub := range o.subscriptions() {
+		if !topicMatches(sub.Filter, topic) {
+			continue
+		}
+		filterParts := strings.Split(sub.Filter, "/")
+		for i := len(filterParts) - 1; i >= 0; i-- {
+			if filterParts[i] == "#" {
+				break
+			}
+			if filterParts[i] == "+" {
+				return topicParts[i]
+			}
+		}
+		break
+	}
+	return topicParts[len(topicParts)-1]
+}
+
+// extractDeviceID applies the configured strategy: DEVICE_ID_PATTERN (first
+// capture group, or the whole match), DEVICE_ID_TOPIC_INDEX (negative values
+// count from the end) or deviceIDFromTopic. An empty result falls back to the
+// last non-empty topic segment, then to the full topic.
+func (o *Orchestrator) extractDeviceID(topic string) string {
+	var deviceID string
+	switch {
+	case o.cfg.DeviceIDPattern != nil:
+		if m := o.cfg.DeviceIDPattern.FindStringSubmatch(topic); m != nil {
+			deviceID = m[0]
+			if len(m) > 1 {
+				deviceID = m[1]
+			}
+		}
+	case o.cfg.DeviceIDIndex != nil:
+		parts := strings.Split(topic, "/")
+		i := *o.cfg.DeviceIDIndex
+		if i < 0 {
+			i += len(parts)
+		}
+		if i >= 0 && i < len(parts) {
+			deviceID = parts[i]
+		}
+	default:
+		deviceID = o.deviceIDFromTopic(topic)
+	}
+
+	if deviceID != "" {
+		return deviceID
+	}
+
+	// Topics such as "mesh/data/abc/" end in an empty segment; attribute them
+	// to the last non-empty one rather than to an empty device ID.
+	parts := strings.Split(topic, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] != "" {
+			slog.Warn("Could not extract device ID, using last non-empty topic segment", "component", "mqtt", "topic", topic, "device_id", parts[i])
+			return parts[i]
+		}
+	}
+	slog.Warn("Could not extract device ID, using full topic", "component", "mqtt", "topic", topic)
+	return topic
+}
+
+// checkGrantedQoS records the QoS the broker granted each of subs, warning
+// about subscriptions granted a lower QoS than requested: their messages are
+// delivered with weaker guarantees than configured. It returns an error if
+// the broker rejected any of them.
+func (o *Orchestrator) checkGrantedQoS(subs []subscription, granted []byte) error {
+	var rejected []string
+	for i, sub := range subs {
+		if i >= len(granted) {
+			break
+		}
+		qos := granted[i]
+		if qos >= 0x80 {
+			rejected = append(rejected, sub.Filter)
+			continue
+		}
+		subscriptionGrantedQoS.WithLabelValues(sub.Filter).Set(float64(qos))
+		if qos < sub.QoS {
+			subscriptionDowngrades.WithLabelValues(sub.Filter).Inc()
+			slog.Warn("Broker granted a lower QoS than requested", "component", "mqtt", "topic", sub.Filter, "qos", sub.QoS, "granted_qos", qos)
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("broker rejected subscription to %s", strings.Join(rejected, ", "))
+	}
+	return nil
+}
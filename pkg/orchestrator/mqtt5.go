@@ -0,0 +1,260 @@
+// mqtt5.go
+package orchestrator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+)
+
+// mqttV5Client implements brokerClient on top of the paho.golang v5 client.
+// autopaho reconnects on its own, so connection state is tracked from its
+// callbacks.
+type mqttV5Client struct {
+	config    autopaho.ClientConfig
+	cm        *autopaho.ConnectionManager
+	connected atomic.Bool
+	// session is the MQTT_STORE_DIR session state, which autopaho does not
+	// close itself.
+	session *state.State
+}
+
+func (o *Orchestrator) newMQTTv5Client(tlsConfig *tls.Config) (*mqttV5Client, error) {
+	serverURLs := make([]*url.URL, 0, len(o.cfg.MQTTBrokers))
+	for _, broker := range o.cfg.MQTTBrokers {
+		u, err := url.Parse(o.brokerURL("mqtt", "tls", broker))
+		if err != nil {
+			return nil, fmt.Errorf("broker %q: %w", broker, err)
+		}
+		serverURLs = append(serverURLs, u)
+	}
+
+	c := &mqttV5Client{}
+	c.config = autopaho.ClientConfig{
+		ServerUrls: serverURLs,
+		TlsCfg:     tlsConfig,
+		KeepAlive:  30,
+		// Same as v3.1.1: QoS 1/2 subscriptions need the session (and queued
+		// messages) to survive reconnects.
+		CleanStartOnInitialConnection: !o.cfg.MQTTPersistentSession,
+		ReconnectBackoff:              o.reconnectBackoff,
+		ConnectUsername:               o.cfg.MQTTUsername,
+		ConnectPassword:               []byte(o.cfg.MQTTPassword),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			c.connected.Store(true)
+			slog.Info("Connected to broker", "component", "mqtt", "version", 5)
+			o.publishStatus(c, o.cfg.OnlinePayload)
+			subs := o.brokerSubscriptions(o.subscriptions())
+			for _, sub := range subs {
+				slog.Info("Subscribing", "component", "mqtt", "topic", sub.Filter, "qos", sub.QoS)
+			}
+			granted, err := subscribeV5(cm, subs)
+			if err == nil {
+				err = o.checkGrantedQoS(subs, granted)
+			}
+			if err != nil {
+				o.failRun(fmt.Errorf("subscribe: %w", err))
+			}
+		},
+		OnConnectError: func(err error) {
+			slog.Warn("Connection attempt failed", "component", "mqtt", "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   o.cfg.MQTTClientID,
+			EnableManualAcknowledgment: o.cfg.ManualAck,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					msg := inboundFromPublish(pr.Packet)
+					if o.cfg.ManualAck {
+						msg.ack = func() {
+							// paho holds acks back until every earlier
+							// publish is acknowledged, as MQTT requires.
+							if err := pr.Client.Ack(pr.Packet); err != nil {
+								slog.Warn("Failed to acknowledge message", "component", "mqtt", "topic", pr.Packet.Topic, "error", err)
+							}
+						}
+					}
+					o.dispatchMessage(msg)
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				c.connected.Store(false)
+				slog.Warn("Connection lost", "component", "mqtt", "error", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connected.Store(false)
+				slog.Warn("Disconnected by broker", "component", "mqtt", "reason_code", d.ReasonCode)
+			},
+		},
+	}
+	if o.cfg.MQTTStoreDir != "" {
+		session, err := openSessionStore(o.cfg.MQTTStoreDir)
+		if err != nil {
+			return nil, fmt.Errorf("open MQTT session store: %w", err)
+		}
+		c.session = session
+		c.config.Session = session
+	}
+	// v5 ends the session on disconnect unless an expiry is requested.
+	c.config.SessionExpiryInterval = uint32(o.cfg.MQTTSessionExpiry / time.Second)
+	if o.cfg.LWTTopic != "" {
+		c.config.WillMessage = &paho.WillMessage{
+			Topic:   o.cfg.LWTTopic,
+			Payload: []byte(o.cfg.LWTPayload),
+			QoS:     o.cfg.LWTQoS,
+			Retain:  o.cfg.LWTRetained,
+		}
+	}
+	return c, nil
+}
+
+// openSessionStore keeps the client and server halves of the v5 session in
+// dir, so unacknowledged QoS 1/2 packets survive a restart.
+func openSessionStore(dir string) (*state.State, error) {
+	// file.New does not create a missing directory itself.
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	client, err := file.New(dir, "client", ".pkt")
+	if err != nil {
+		return nil, err
+	}
+	server, err := file.New(dir, "server", ".pkt")
+	if err != nil {
+		return nil, err
+	}
+	return state.New(client, server), nil
+}
+
+// reconnectBackoff doubles MQTT_CONNECT_RETRY_INTERVAL per failed attempt, up
+// to MQTT_MAX_RECONNECT_INTERVAL.
+func (o *Orchestrator) reconnectBackoff(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+	delay := o.cfg.MQTTConnectRetry
+	for i := 1; i < attempt && delay < o.cfg.MQTTMaxReconnect; i++ {
+		delay *= 2
+	}
+	return min(delay, o.cfg.MQTTMaxReconnect)
+}
+
+// Connect starts the connection manager and waits for the first connection.
+func (c *mqttV5Client) Connect(ctx context.Context) error {
+	cm, err := autopaho.NewConnection(context.Background(), c.config)
+	if err != nil {
+		return err
+	}
+	c.cm = cm
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return cm.AwaitConnection(ctx)
+}
+
+func (c *mqttV5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5Client) Publish(topic string, qos byte, retained bool, payload string) error {
+	if c.cm == nil {
+		return errors.New("not connected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: []byte(payload),
+	})
+	return err
+}
+
+func (c *mqttV5Client) Subscribe(subs []subscription) ([]byte, error) {
+	if c.cm == nil {
+		return nil, errors.New("not connected")
+	}
+	return subscribeV5(c.cm, subs)
+}
+
+func (c *mqttV5Client) Unsubscribe(filters []string) error {
+	if c.cm == nil {
+		return errors.New("not connected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: filters})
+	return err
+}
+
+// subscribeV5 subscribes to subs and returns the SUBACK reason codes, which
+// are the granted QoS for successful subscriptions.
+func subscribeV5(cm *autopaho.ConnectionManager, subs []subscription) ([]byte, error) {
+	opts := make([]paho.SubscribeOptions, 0, len(subs))
+	for _, sub := range subs {
+		opts = append(opts, paho.SubscribeOptions{Topic: sub.Filter, QoS: sub.QoS})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	suback, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: opts})
+	if err != nil {
+		return nil, err
+	}
+	return suback.Reasons, nil
+}
+
+func (c *mqttV5Client) Disconnect() {
+	if c.cm == nil {
+		return
+	}
+	c.connected.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := c.cm.Disconnect(ctx); err != nil {
+		slog.Warn("Disconnect failed", "component", "mqtt", "error", err)
+	}
+	if c.session != nil {
+		if err := c.session.Close(); err != nil {
+			slog.Warn("Failed to close MQTT session store", "component", "mqtt", "error", err)
+		}
+	}
+}
+
+// inboundFromPublish converts a v5 publish, keeping its content type and user
+// properties. Repeated user property keys keep the last value.
+func inboundFromPublish(p *paho.Publish) Message {
+	msg := Message{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		Meta: MQTTMeta{
+			Retained:  p.Retain,
+			QoS:       p.QoS,
+			Duplicate: p.Duplicate(),
+			PacketID:  p.PacketID,
+		},
+	}
+	if p.Properties == nil {
+		return msg
+	}
+	msg.ContentType = p.Properties.ContentType
+	if len(p.Properties.User) > 0 {
+		msg.UserProperties = make(map[string]string, len(p.Properties.User))
+		for _, prop := range p.Properties.User {
+			msg.UserProperties[prop.Key] = prop.Value
+		}
+	}
+	return msg
+}
@@ -0,0 +1,49 @@
+// mqtt_test.go
+package orchestrator
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestExtractDeviceID(t *testing.T) {
+	index := func(i int) *int { return &i }
+	tests := []struct {
+		name    string
+		filters []string
+		pattern string
+		index   *int
+		topic   string
+		want    string
+	}{
+		{name: "last wildcard", filters: []string{"mesh/data/+"}, topic: "mesh/data/abc", want: "abc"},
+		{name: "last of several wildcards", filters: []string{"site/+/sensors/+"}, topic: "site/lab/sensors/abc", want: "abc"},
+		{name: "multi-level after wildcard", filters: []string{"mesh/+/#"}, topic: "mesh/abc/temp/1", want: "1"},
+		{name: "multi-level filter", filters: []string{"mesh/#"}, topic: "mesh/data/abc", want: "abc"},
+		{name: "matching filter", filters: []string{"other/+", "mesh/+/data"}, topic: "mesh/abc/data", want: "abc"},
+		{name: "trailing slash", filters: []string{"mesh/#"}, topic: "mesh/data/abc/", want: "abc"},
+		{name: "empty wildcard segment", filters: []string{"mesh/+"}, topic: "mesh/", want: "mesh"},
+		{name: "only slashes", filters: []string{"#"}, topic: "/", want: "/"},
+		{name: "pattern group", pattern: `^devices/([^/]+)/`, topic: "devices/abc/temp", want: "abc"},
+		{name: "pattern match", pattern: `[0-9a-f]{12}`, topic: "mesh/24a160e5a1fc/temp", want: "24a160e5a1fc"},
+		{name: "pattern without match", pattern: `^devices/([^/]+)/`, topic: "mesh/data/abc", want: "abc"},
+		{name: "index", index: index(1), topic: "mesh/abc/temp", want: "abc"},
+		{name: "negative index", index: index(-2), topic: "mesh/abc/temp", want: "abc"},
+		{name: "index out of range", index: index(5), topic: "mesh/abc/temp", want: "temp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{DeviceIDIndex: tt.index}
+			for _, filter := range tt.filters {
+				cfg.Subscriptions = append(cfg.Subscriptions, subscription{Filter: filter})
+			}
+			if tt.pattern != "" {
+				cfg.DeviceIDPattern = regexp.MustCompile(tt.pattern)
+			}
+			o := newOrchestrator(cfg)
+			if got := o.extractDeviceID(tt.topic); got != tt.want {
+				t.Errorf("extractDeviceID(%q) = %q, want %q", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+// orchestrator.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
+)
+
+// Orchestrator moves readings from the broker into the storage backend. It owns its
+// configuration, connections and background workers; only metrics, the log
+// level and the tracer provider are process-wide.
+type Orchestrator struct {
+	cfg Config
+
+	// client is the broker connection, also used by background tasks that
+	// publish (acks, presence).
+	client brokerClient
+
+	// store is the STORAGE_BACKEND readings are written to.
+	store Store
+
+	// mongoMu guards the client and collections, which are swapped out on
+	// reconnect while the health server may be reading them.
+	mongoMu            sync.RWMutex
+	mongoClient        *mongo.Client
+	mongoDatabase      *mongo.Database
+	dataCollection     *mongo.Collection
+	latestCollection   *mongo.Collection
+	dlqCollection      *mongo.Collection
+	presenceCollection *mongo.Collection
+	rollupCollection   *mongo.Collection
+	mongoClientOpts    *options.ClientOptions
+	// quarantineCollection is set when DLQ_MAX_RETRIES > 0.
+	quarantineCollection *mongo.Collection
+
+	// cipherClient is shared by all cipher API calls so connections are kept
+	// alive and reused. It is set up by initCipherClient.
+	cipherClient  *http.Client
+	cipherBreaker *circuitBreaker
+
+	// diag holds the latest outcomes shown by GET /debug/status.
+	diag diagnostics
+
+	// grpcServer serves the Ingest service; nil unless GRPC_PORT is set.
+	grpcServer *grpc.Server
+
+	// Optional stages, nil unless configured.
+	payloadSchema *jsonschema.Schema
+	dedup         *deduplicator
+	diskBuf       *diskBuffer
+	presence      *presenceTracker
+	sampler       *sampler
+	rollups       *rollupAggregator
+
+	// Settings POST /admin/reload can swap while messages are handled.
+	// limiter is nil when rate limiting is off, transformRules when there
+	// are no TRANSFORM_RULES.
+	limiter        atomic.Pointer[rateLimiter]
+	transformRules atomic.Pointer[transformRules]
+	// subsMu guards subs, the topic filters currently subscribed to.
+	subsMu sync.RWMutex
+	subs   []subscription
+	// reloadMu serializes reloads and guards applied, the configuration in
+	// effect: cfg with the settings reloaded since startup.
+	reloadMu sync.Mutex
+	applied  Config
+
+	// workCtx is the parent of all message handling, encryption and inserts.
+	// It is cancelled by cancelWork when the shutdown timeout expires, so
+	// that nothing outlives the shutdown.
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+
+	// inflight tracks messages and readings that have not reached the batch
+	// writer yet, so shutdown can wait for them before closing batchQueue.
+	inflight sync.WaitGroup
+	// inflightLimit holds a slot per message between dispatchMessage and
+	// the end of HandleMessage when MAX_INFLIGHT > 0.
+	inflightLimit chan struct{}
+	// workQueue is set when WORKERS > 0. MQTT callbacks then only enqueue
+	// messages, and the workers run HandleMessage.
+	workQueue chan Message
+	// encryptQueue is set when ENCRYPT_BATCH_SIZE > 1 or ENCRYPT_CONCURRENCY
+	// > 0. Store hands readings to it and the encrypt batcher, or the encrypt
+	// workers, finish storing them.
+	encryptQueue chan SensorData
+	// queueReaders tracks the workers and the encrypt stage, which return
+	// once shutdown closes workQueue and encryptQueue.
+	queueReaders sync.WaitGroup
+	// batchQueue receives readings from Store; the batch writer drains it and
+	// flushes them with InsertMany.
+	batchQueue chan SensorData
+
+	// runErrs receives an error that ends Run: a server that stopped
+	// serving or a subscription the broker rejected.
+	runErrs chan error
+
+	// Closed once the corresponding background loop has stopped.
+	batchDone    chan struct{}
+	dlqDone      chan struct{}
+	bufferDone   chan struct{}
+	presenceDone chan struct{}
+	rollupDone   chan struct{}
+}
+
+// New prepares an orchestrator for cfg, typically from LoadConfig: it opens
+// the storage file, the disk buffer and the schema and sets up the broker
+// client, but connects to nothing until Run.
+func New(cfg Config) (*Orchestrator, error) {
+	o := newOrchestrator(cfg)
+	if err := o.openStore(); err != nil {
+		return nil, err
+	}
+	err := o.loadSchema()
+	if err == nil {
+		err = o.openDiskBuffer()
+	}
+	if err == nil {
+		o.client, err = o.newBrokerClient()
+	}
+	if err != nil {
+		o.store.Close(context.Background())
+		return nil, err
+	}
+	return o, nil
+}
+
+// newOrchestrator returns an orchestrator with nothing opened yet, for New
+// and for the replay command.
+func newOrchestrator(cfg Config) *Orchestrator {
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	var inflightLimit chan struct{}
+	if cfg.MaxInflight > 0 {
+		inflightLimit = make(chan struct{}, cfg.MaxInflight)
+	}
+	o := &Orchestrator{
+		cfg:           cfg,
+		subs:          cfg.Subscriptions,
+		applied:       cfg,
+		workCtx:       workCtx,
+		cancelWork:    cancelWork,
+		inflightLimit: inflightLimit,
+		cipherBreaker: newCircuitBreaker(cfg.CipherBreakerThreshold, cfg.CipherBreakerCooldown),
+		runErrs:       make(chan error, 1),
+		batchDone:     make(chan struct{}),
+		dlqDone:       make(chan struct{}),
+		bufferDone:    make(chan struct{}),
+		presenceDone:  make(chan struct{}),
+		rollupDone:    make(chan struct{}),
+	}
+	o.transformRules.Store(cfg.TransformRules)
+	return o
+}
+
+// Run connects to the storage backend and the broker and stores readings
+// until ctx is done, then shuts down gracefully within SHUTDOWN_TIMEOUT. It
+// returns an error if a port cannot be listened on, the MongoDB server fails
+// MONGO_VERSION_CHECK=fail, the indexes could not be set up, the broker
+// connection could not be established, a server stops serving or the broker
+// rejects a subscription, in which case it shuts down the same way first. An
+// orchestrator runs only once.
+func (o *Orchestrator) Run(ctx context.Context) error {
+	ctx, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+
+	if o.cfg.DryRun {
+		slog.Warn("Dry run, readings will not be stored", "component", "main")
+	}
+
+	o.initCipherClient()
+	listeners, err := o.openListeners()
+	if err != nil {
+		o.store.Close(context.Background())
+		return err
+	}
+	servers := []*http.Server{o.startHealthServer(listeners.health), o.startMetricsServer(listeners.metrics)}
+	if listeners.api != nil {
+		servers = append(servers, o.startAPIServer(listeners.api))
+	}
+
+	o.openRateLimiter()
+	o.openDeduplicator()
+	o.openSampler()
+	o.openRollups()
+	if !o.waitStartupJitter(ctx) {
+		o.abortStartup(servers, listeners)
+		return nil
+	}
+	if o.cfg.StorageBackend == "mongo" {
+		if err := o.connectMongo(ctx); err != nil {
+			// Only ctx ends the connection attempts, so this is a
+			// shutdown rather than a failure.
+			o.abortStartup(servers, listeners)
+			return nil
+		}
+		err := o.checkServerVersion()
+		if err == nil && !o.cfg.DryRun {
+			err = o.ensureIndexes()
+		}
+		if err != nil {
+			o.abortStartup(servers, listeners)
+			return err
+		}
+	}
+	o.startBatchWriter()
+	o.startEncryptStage()
+	o.startWorkers()
+	o.startGRPCServer(listeners.grpc)
+	if server := o.startIngestServer(listeners.ingest); server != nil {
+		servers = append(servers, server)
+	}
+	o.startDLQRetrier(ctx)
+	o.startBufferReplay(ctx)
+	o.startPresenceTracker(ctx)
+	o.startStatsPublisher(ctx)
+	o.startSampleFlusher(ctx)
+	o.startRollupFlusher(ctx)
+
+	if err := o.client.Connect(ctx); err != nil && ctx.Err() == nil {
+		// Stop the background loops and drain what the other inputs
+		// already accepted, as on a signal.
+		stopRun()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), o.cfg.ShutdownTimeout)
+		defer cancel()
+		o.shutdown(shutdownCtx, servers...)
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received", "component", "main")
+	case err = <-o.runErrs:
+		slog.Error("Shutting down after a failure", "component", "main", "error", err)
+		stopRun()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), o.cfg.ShutdownTimeout)
+	defer cancel()
+	o.shutdown(shutdownCtx, servers...)
+	return err
+}
+
+// failRun ends Run with err. Only the first failure is reported.
+func (o *Orchestrator) failRun(err error) {
+	select {
+	case o.runErrs <- err:
+	default:
+	}
+}
+
+// listeners are the ports Run serves on. api, grpc and ingest are nil when
+// that server is off.
+type listeners struct {
+	health, metrics, api, grpc, ingest net.Listener
+}
+
+// openListeners listens on every port Run serves on, so that a port in use
+// fails Run before anything else starts.
+func (o *Orchestrator) openListeners() (listeners, error) {
+	var l listeners
+	apiPort := o.cfg.APIPort
+	if o.cfg.StorageBackend != "mongo" {
+		// The read-back API queries MongoDB directly.
+		apiPort = ""
+	}
+	ports := []struct {
+		component, port string
+		listener        *net.Listener
+	}{
+		{"health", o.cfg.HealthPort, &l.health},
+		{"metrics", o.cfg.MetricsPort, &l.metrics},
+		{"api", apiPort, &l.api},
+		{"grpc", o.cfg.GRPCPort, &l.grpc},
+		{"ingest", o.cfg.IngestPort, &l.ingest},
+	}
+	for _, p := range ports {
+		if p.port == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", ":"+p.port)
+		if err != nil {
+			l.close()
+			return listeners{}, fmt.Errorf("%s server: %w", p.component, err)
+		}
+		*p.listener = listener
+	}
+	return l, nil
+}
+
+// close closes the listeners that are open.
+func (l listeners) close() {
+	for _, listener := range []net.Listener{l.health, l.metrics, l.api, l.grpc, l.ingest} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// serve serves server on listener in the background, failing Run if it
+// stops for any reason but a shutdown.
+func (o *Orchestrator) serve(component string, server *http.Server, listener net.Listener) {
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			o.failRun(fmt.Errorf("%s server: %w", component, err))
+		}
+	}()
+}
+
+// closeQueues closes workQueue and encryptQueue, once nothing is in flight,
+// and waits for the goroutines reading them to return.
+func (o *Orchestrator) closeQueues() {
+	if o.workQueue != nil {
+		close(o.workQueue)
+	}
+	if o.encryptQueue != nil {
+		close(o.encryptQueue)
+	}
+	o.queueReaders.Wait()
+}
+
+// abortStartup closes what Run started before connecting to the storage
+// backend.
+func (o *Orchestrator) abortStartup(servers []*http.Server, l listeners) {
+	for _, server := range servers {
+		server.Close()
+	}
+	l.close()
+	o.store.Close(context.Background())
+}
+
+// waitStartupJitter waits for a random time up to STARTUP_JITTER, so that
+// replicas restarted together do not all connect at once. The health
+// endpoints are already served meanwhile. It reports false if ctx was done
+// first.
+func (o *Orchestrator) waitStartupJitter(ctx context.Context) bool {
+	if o.cfg.StartupJitter == 0 {
+		return true
+	}
+	delay := rand.N(o.cfg.StartupJitter)
+	slog.Info("Delaying startup", "component", "main", "delay", delay, "max", o.cfg.StartupJitter)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown disconnects from the broker, waits for pending writes and the last
+// batch flush until ctx expires and then closes the store. Work still running
+// when ctx expires is cancelled.
+func (o *Orchestrator) shutdown(ctx context.Context, servers ...*http.Server) {
+	stop := context.AfterFunc(ctx, o.cancelWork)
+	defer stop()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("HTTP server shutdown failed", "component", "shutdown", "addr", server.Addr, "error", err)
+		}
+	}
+	o.stopGRPCServer(ctx)
+
+	// The broker only sends the will on an unclean disconnect, so announce
+	// the shutdown ourselves.
+	o.publishStatus(o.client, o.cfg.LWTPayload)
+	o.client.Disconnect()
+	slog.Info("Disconnected from broker", "component", "mqtt")
+	o.flushSamples()
+
+	done := make(chan struct{})
+	go func() {
+		o.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		o.closeQueues()
+		close(o.batchQueue)
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for pending writes", "component", "shutdown")
+	}
+
+	select {
+	case <-o.batchDone:
+		slog.Info("Pending writes completed", "component", "shutdown")
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for final batch flush", "component", "shutdown")
+	}
+
+	select {
+	case <-o.dlqDone:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for DLQ retrier", "component", "shutdown")
+	}
+
+	select {
+	case <-o.bufferDone:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for buffer replay", "component", "shutdown")
+	}
+
+	select {
+	case <-o.presenceDone:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for presence tracker", "component", "shutdown")
+	}
+
+	select {
+	case <-o.rollupDone:
+		o.flushRollups()
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for rollup flusher", "component", "shutdown")
+	}
+
+	if err := o.store.Close(ctx); err != nil {
+		slog.Error("Failed to close store", "component", "store", "backend", o.cfg.StorageBackend, "error", err)
+		return
+	}
+	slog.Info("Store closed", "component", "store", "backend", o.cfg.StorageBackend)
+}
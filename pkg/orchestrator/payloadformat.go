@@ -0,0 +1,124 @@
+// payloadformat.go
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// formatRoute declares the payload format of topics matching Filter.
+type formatRoute struct {
+	Filter string
+	Format string
+}
+
+// payloadFormats are the FORMAT_BY_TOPIC formats: "json" is always parsed
+// into payload_json, "csv" is split into payload_csv rows (or, with
+// CSV_HEADERS, parsed into payload_json) and "raw" is stored as it arrives.
+var payloadFormats = map[string]bool{"json": true, "csv": true, "raw": true}
+
+// parseFormatRoutes parses a JSON object such as
+// {"+/+/json": "json", "+/+/csv": "csv"}. As with TOPIC_COLLECTION_MAP the
+// first matching filter wins, so key order is kept.
+func parseFormatRoutes(v string) ([]formatRoute, error) {
+	dec := json.NewDecoder(strings.NewReader(v))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("must be a JSON object of topic filter to format")
+	}
+	var routes []formatRoute
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var format string
+		if err := dec.Decode(&format); err != nil {
+			return nil, fmt.Errorf("filter %q: format must be a string", tok)
+		}
+		format = strings.ToLower(format)
+		if !payloadFormats[format] {
+			return nil, fmt.Errorf("filter %q: %q must be json, csv or raw", tok, format)
+		}
+		routes = append(routes, formatRoute{Filter: tok.(string), Format: format})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// payloadFormat returns the format declared for topic, or "" when no route
+// matches and the payload is handled as before.
+func (o *Orchestrator) payloadFormat(topic string) string {
+	for _, route := range o.cfg.FormatRoutes {
+		if topicMatches(route.Filter, topic) {
+			return route.Format
+		}
+	}
+	return ""
+}
+
+// parseCSVPayload splits payload into rows of fields. Rows may have different
+// numbers of fields; blank lines are skipped.
+func parseCSVPayload(payload []byte) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(payload))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no rows")
+	}
+	return rows, nil
+}
+
+// parseCSVHeaders parses CSV_HEADERS, the comma-separated names of the
+// fields of a csv row.
+func parseCSVHeaders(v string) ([]string, error) {
+	var headers []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return nil, errors.New("empty field name")
+		case strings.HasPrefix(name, "$") || strings.Contains(name, "."):
+			return nil, fmt.Errorf("%q is not a valid field name", name)
+		case slices.Contains(headers, name):
+			return nil, fmt.Errorf("%q is listed twice", name)
+		}
+		headers = append(headers, name)
+	}
+	return headers, nil
+}
+
+// csvDocument names the fields of the single row of a csv payload after
+// headers. Numeric fields are stored as doubles and the others as strings.
+func csvDocument(rows [][]string, headers []string) (map[string]interface{}, error) {
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("%d rows, expected 1", len(rows))
+	}
+	row := rows[0]
+	if len(row) != len(headers) {
+		return nil, fmt.Errorf("%d fields, expected %d", len(row), len(headers))
+	}
+	doc := make(map[string]interface{}, len(row))
+	for i, field := range row {
+		field = strings.TrimSpace(field)
+		// NaN and infinities cannot be encoded as JSON.
+		if n, err := strconv.ParseFloat(field, 64); err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+			doc[headers[i]] = n
+		} else {
+			doc[headers[i]] = field
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,478 @@
+// pipeline.go
+package orchestrator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SensorData is a reading as it is stored, built from one received message.
+type SensorData struct {
+	// ID is assigned just before the insert, so retries of the same reading
+	// (from the DLQ or the disk buffer) cannot store it twice.
+	ID primitive.ObjectID `json:"id,omitzero" bson:"_id,omitempty"`
+	// MessageID is a UUID assigned on receipt, identifying the reading in
+	// acks, logs, traces and other systems.
+	MessageID string `json:"message_id,omitempty" bson:"message_id,omitempty"`
+	DeviceID  string `json:"device_id" bson:"device_id"`
+	Payload   string `json:"payload" bson:"payload"`
+	// PayloadJSON is the decoded JSON payload: a document for objects, and
+	// the array, number, string or boolean otherwise.
+	PayloadJSON interface{} `json:"payload_json,omitempty" bson:"payload_json,omitempty"`
+	Timestamp   time.Time   `json:"timestamp" bson:"timestamp"`
+	// ReceivedAt is when the orchestrator received the message, whereas
+	// Timestamp may come from the payload (TIMESTAMP_FIELD).
+	ReceivedAt time.Time `json:"received_at,omitzero" bson:"received_at,omitempty"`
+	// PayloadCSV holds the rows of a payload on a FORMAT_BY_TOPIC csv topic.
+	PayloadCSV [][]string `json:"payload_csv,omitempty" bson:"payload_csv,omitempty"`
+	// PayloadEncoding is "base64" when Payload holds base64-encoded bytes.
+	PayloadEncoding string `json:"payload_encoding,omitempty" bson:"payload_encoding,omitempty"`
+	// PayloadFormat is the FORMAT_BY_TOPIC format of the topic, if any.
+	PayloadFormat string `json:"payload_format,omitempty" bson:"payload_format,omitempty"`
+	// Site, GatewayID and Environment tag readings with the deployment they
+	// were ingested by (SITE, GATEWAY_ID and ENV).
+	Site        string `json:"site,omitempty" bson:"site,omitempty"`
+	GatewayID   string `json:"gateway_id,omitempty" bson:"gateway_id,omitempty"`
+	Environment string `json:"environment,omitempty" bson:"environment,omitempty"`
+	// Collection is the TOPIC_COLLECTION_MAP target, empty for the default
+	// collection. It is not part of the stored document.
+	Collection string `json:"collection,omitempty" bson:"-"`
+	// ContentType and UserProperties carry the MQTT v5 publish properties.
+	ContentType    string            `json:"content_type,omitempty" bson:"content_type,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty" bson:"user_properties,omitempty"`
+	// Retained is set on readings from retained messages with
+	// RETAINED_ACTION=flag.
+	Retained bool `json:"retained,omitempty" bson:"retained,omitempty"`
+	// Stale is set on readings older than MAX_MESSAGE_AGE that are stored
+	// anyway (STALE_ACTION flag or archive).
+	Stale bool `json:"stale,omitempty" bson:"stale,omitempty"`
+	// Samples is the number of readings averaged into this one with
+	// SAMPLE_MODE=average.
+	Samples int `json:"samples,omitempty" bson:"samples,omitempty"`
+	// MQTT holds the delivery flags of the message with STORE_MQTT_META.
+	MQTT *MQTTMeta `json:"mqtt,omitempty" bson:"mqtt,omitempty"`
+	// Fields holds the EXTRACT_FIELDS values, stored as top-level fields.
+	Fields map[string]interface{} `json:"fields,omitempty" bson:",inline"`
+	// Encrypted is set when the payload was encrypted whole.
+	Encrypted bool `json:"encrypted,omitempty" bson:"encrypted,omitempty"`
+	// EncryptedFields lists the ENCRYPT_FIELDS that were encrypted in place;
+	// empty when the payload was encrypted whole.
+	EncryptedFields []string `json:"encrypted_fields,omitempty" bson:"encrypted_fields,omitempty"`
+	// Envelope is the key ID and IV the cipher API returned for the whole
+	// payload, FieldEnvelopes those of each encrypted field.
+	Envelope       *CipherEnvelope           `json:"envelope,omitempty" bson:"envelope,omitempty"`
+	FieldEnvelopes map[string]CipherEnvelope `json:"field_envelopes,omitempty" bson:"field_envelopes,omitempty"`
+
+	// topic is the topic the message was received on, deciding on
+	// ENCRYPT_TOPICS. It is not stored.
+	topic string
+	// spanCtx is the span of the message that produced the reading, so later
+	// stages can join its trace.
+	spanCtx trace.SpanContext
+	// ack acknowledges the message to the broker with MANUAL_ACK; see
+	// acknowledge.
+	ack func()
+	// lost reports a reading that could not be stored; see fail.
+	lost func(error)
+	// forget removes the message from the deduplicator when the reading is
+	// lost; see fail.
+	forget func()
+}
+
+// Store encrypts data when ENCRYPTION is on, and ENCRYPT_TOPICS matches its
+// topic, and hands it to the batch writer. Both steps give up once ctx is
+// done.
+func (o *Orchestrator) Store(ctx context.Context, data SensorData) {
+	if o.encrypts(data) {
+		if o.encryptQueue != nil {
+			o.inflight.Add(1)
+			select {
+			case o.encryptQueue <- data:
+			case <-ctx.Done():
+				// Dead-lettered at the encrypt stage, the reading is
+				// encrypted when it is retried.
+				o.inflight.Done()
+				messagesDropped.WithLabelValues("timeout").Inc()
+				slog.Error("Timed out waiting for the encryption queue", "component", "cipher", "device_id", data.DeviceID, "message_id", data.MessageID, "error", ctx.Err())
+				failure := newProcessError(stageEncrypt, ctx.Err())
+				failure.record(1)
+				o.writeDeadLetter(data, failure)
+			}
+			return
+		}
+		encryptCtx, span := tracer.Start(ctx, "encrypt")
+		sealed, err := o.encryptReading(encryptCtx, data)
+		endSpan(span, err)
+		var ok bool
+		if data, ok = o.applyEncryption(sealed, err); !ok {
+			return
+		}
+	}
+	o.persist(ctx, data)
+}
+
+// applyEncryption applies ENCRYPT_FALLBACK when encrypting data failed. It
+// reports whether the reading should still be stored.
+func (o *Orchestrator) applyEncryption(data SensorData, err error) (SensorData, bool) {
+	if err == nil {
+		return data, true
+	}
+	failure := newProcessError(stageEncrypt, err)
+	failure.record(1)
+	switch o.cfg.EncryptFallback {
+	case "plaintext":
+		slog.Warn("Encrypt failed, storing plaintext", "component", "cipher", "device_id", data.DeviceID, "message_id", data.MessageID, "code", failure.Code, "error", err)
+		return data, true
+	case "dlq":
+		slog.Warn("Encrypt failed, sending to DLQ", "component", "cipher", "device_id", data.DeviceID, "message_id", data.MessageID, "code", failure.Code, "error", err)
+		if o.cfg.DryRun {
+			data.acknowledge()
+		} else {
+			o.writeDeadLetter(data, failure)
+		}
+	default:
+		slog.Error("Encrypt failed, dropping reading", "component", "cipher", "device_id", data.DeviceID, "message_id", data.MessageID, "code", failure.Code, "error", err)
+		data.fail(failure)
+		data.acknowledge()
+	}
+	return data, false
+}
+
+// persist queues data for the batch writer.
+// If the queue stays full until ctx is done, the reading goes to the DLQ.
+func (o *Orchestrator) persist(ctx context.Context, data SensorData) {
+	if o.cfg.DryRun {
+		slog.Info("Dry run, not storing", "component", "mongodb", "document", data)
+		data.acknowledge()
+		return
+	}
+
+	select {
+	case o.batchQueue <- data:
+		return
+	default:
+	}
+	select {
+	case o.batchQueue <- data:
+	case <-ctx.Done():
+		messagesDropped.WithLabelValues("timeout").Inc()
+		slog.Error("Timed out waiting for the batch writer", "component", "batch", "device_id", data.DeviceID, "message_id", data.MessageID, "error", ctx.Err())
+		failure := newProcessError(stageInsert, ctx.Err())
+		failure.record(1)
+		o.writeDeadLetter(data, failure)
+	}
+}
+
+// HandleMessage turns a received message into a reading and stores it,
+// unless it is dropped on the way (size, rate limit, duplicate, schema).
+// While Run is running it may also be called with messages from other
+// sources.
+func (o *Orchestrator) HandleMessage(msg Message) {
+	o.inflight.Add(1)
+	defer o.inflight.Done()
+
+	received := time.Now()
+	messagesReceived.WithLabelValues(msg.Topic).Inc()
+
+	// A message dropped on the way is acknowledged here; one that becomes a
+	// reading is acknowledged once the reading is stored or dead-lettered.
+	ack := msg.ack
+	defer func() {
+		if ack != nil {
+			ack()
+		}
+	}()
+
+	ctx := o.workCtx
+	if o.cfg.MessageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.cfg.MessageTimeout)
+		defer cancel()
+	}
+
+	deviceID := msg.deviceID
+	if deviceID == "" {
+		deviceID = o.extractDeviceID(msg.Topic)
+	}
+	format := o.payloadFormat(msg.Topic)
+	messageID := newMessageID()
+	ctx, span := tracer.Start(messageContext(ctx, msg), "handle message", trace.WithAttributes(
+		attribute.String("mqtt.topic", msg.Topic),
+		attribute.String("device_id", deviceID),
+		attribute.String("message.id", messageID),
+	))
+	defer span.End()
+	if o.isGzip(msg) {
+		payload, err := o.gunzip(msg.Payload)
+		if err != nil {
+			messagesDropped.WithLabelValues("decompress").Inc()
+			slog.Warn("Failed to decompress payload, dropping reading", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "error", err)
+			return
+		}
+		msg.Payload = payload
+	}
+	if o.cfg.PayloadCharset != nil {
+		// Bytes the charset does not define become U+FFFD rather than
+		// errors, so this only fails on broken decoders.
+		if payload, err := o.cfg.PayloadCharset.NewDecoder().Bytes(msg.Payload); err == nil {
+			msg.Payload = payload
+		} else {
+			slog.Warn("Failed to transcode payload, storing it as received", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "error", err)
+		}
+	}
+	if msg.Meta.Retained && o.cfg.RetainedAction == "skip" {
+		messagesDropped.WithLabelValues("retained").Inc()
+		slog.Debug("Skipping retained message", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic)
+		return
+	}
+	if o.presence != nil {
+		o.presence.seen(deviceID, received)
+	}
+	if o.cfg.MaxPayloadBytes > 0 && len(msg.Payload) > o.cfg.MaxPayloadBytes {
+		messagesDropped.WithLabelValues("too_large").Inc()
+		slog.Warn("Payload too large, dropping reading", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "bytes", len(msg.Payload), "max_bytes", o.cfg.MaxPayloadBytes)
+		return
+	}
+	if l := o.limiter.Load(); l != nil && !l.allow(deviceID, received) {
+		messagesDropped.WithLabelValues("rate_limit").Inc()
+		return
+	}
+	if o.dedup != nil && o.dedup.seen(deviceID, msg.Payload, received) {
+		messagesDuplicate.Inc()
+		slog.Debug("Skipping duplicate message", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic)
+		return
+	}
+
+	data := SensorData{
+		MessageID:      messageID,
+		DeviceID:       deviceID,
+		Payload:        string(msg.Payload),
+		Timestamp:      received,
+		ReceivedAt:     received,
+		PayloadFormat:  format,
+		Site:           o.cfg.Site,
+		GatewayID:      o.cfg.GatewayID,
+		Environment:    o.cfg.Environment,
+		Collection:     o.routeCollection(msg.Topic),
+		ContentType:    msg.ContentType,
+		UserProperties: msg.UserProperties,
+		topic:          msg.Topic,
+		spanCtx:        span.SpanContext(),
+	}
+	if o.cfg.StoreMQTTMeta {
+		meta := msg.Meta
+		data.MQTT = &meta
+	}
+	if msg.Meta.Retained && o.cfg.RetainedAction == "flag" {
+		data.Retained = true
+	}
+	// The schema describes JSON payloads, so topics declared csv or raw are
+	// not validated.
+	if o.payloadSchema != nil && format != "csv" && format != "raw" {
+		if err := o.validatePayload(msg.Payload); err != nil {
+			messagesDropped.WithLabelValues("invalid_schema").Inc()
+			slog.Warn("Payload failed schema validation", "component", "schema", "device_id", deviceID, "topic", msg.Topic, "action", o.cfg.SchemaInvalidAction, "error", err)
+			failure := &ProcessError{Stage: stageValidate, Code: "invalid_schema", Err: err}
+			failure.record(1)
+			if o.cfg.SchemaInvalidAction == "dlq" && !o.cfg.DryRun {
+				o.writeDeadLetter(data, failure)
+			}
+			return
+		}
+	}
+	binary := o.cfg.PayloadEncoding == "base64"
+	if !binary && !utf8.Valid(msg.Payload) {
+		// As a string the payload would be mangled in JSON and BSON, so it
+		// is stored base64-encoded even with PAYLOAD_ENCODING=text.
+		messagesInvalidUTF8.Inc()
+		if o.cfg.PayloadEncoding == "text" {
+			slog.Warn("Payload is not valid UTF-8, storing it base64-encoded", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "bytes", len(msg.Payload))
+		}
+		binary = true
+	}
+	if binary {
+		data.Payload = base64.StdEncoding.EncodeToString(msg.Payload)
+		data.PayloadEncoding = "base64"
+	}
+	rules := o.transformRules.Load()
+	// doc is set for JSON objects, which the stages below work on; value
+	// holds any other JSON payload, which is only stored.
+	var doc map[string]interface{}
+	var value interface{}
+	switch {
+	case binary || format == "raw":
+	case format == "csv":
+		rows, err := parseCSVPayload(msg.Payload)
+		if len(o.cfg.CSVHeaders) > 0 {
+			if err == nil {
+				doc, err = csvDocument(rows, o.cfg.CSVHeaders)
+			}
+			if err != nil {
+				messagesDropped.WithLabelValues("invalid_csv").Inc()
+				slog.Warn("Payload is not a valid CSV row, dropping reading", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "error", err)
+				failure := &ProcessError{Stage: stageParse, Code: "invalid_csv", Err: err}
+				failure.record(1)
+				if !o.cfg.DryRun {
+					o.writeDeadLetter(data, failure)
+				}
+				return
+			}
+			break
+		}
+		if err != nil {
+			slog.Warn("Payload is not valid CSV, storing it raw", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "error", err)
+		}
+		data.PayloadCSV = rows
+	case format == "json" || o.cfg.ParseJSONPayload || o.cfg.FlattenPayload || o.cfg.RouteByField != "" || o.cfg.TimestampField != "" || rules != nil || len(o.cfg.ExtractFields) > 0 || o.rollups != nil:
+		var err error
+		if value, err = parseJSONValue(msg.Payload); err != nil && format == "json" {
+			slog.Warn("Payload is not valid JSON, storing it raw", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "error", err)
+		}
+		doc, _ = value.(map[string]interface{})
+	}
+	if doc != nil && rules != nil {
+		rules.apply(doc)
+		// A csv payload is kept as received; the rules apply to
+		// payload_json only.
+		if format != "csv" {
+			if payload, err := json.Marshal(doc); err == nil {
+				data.Payload = string(payload)
+			}
+		}
+	}
+	if o.cfg.ParseJSONPayload || o.cfg.FlattenPayload || format == "json" || format == "csv" {
+		switch {
+		case doc != nil:
+			data.PayloadJSON = o.payloadJSON(doc)
+		case value != nil:
+			data.PayloadJSON = value
+		}
+	}
+	if o.cfg.RouteByField != "" {
+		if collection := o.fieldCollection(doc, deviceID); collection != "" {
+			data.Collection = collection
+		}
+	}
+	if len(o.cfg.ExtractFields) > 0 {
+		data.Fields = extractFields(doc, o.cfg.ExtractFields)
+	}
+	if o.cfg.TopicTemplate != nil {
+		o.applyTopicTemplate(&data, msg.Topic)
+	}
+	if o.cfg.TimestampField != "" {
+		if ts, ok := payloadTimestamp(doc, o.cfg.TimestampField); ok {
+			data.Timestamp = ts
+			if age := received.Sub(ts); o.cfg.MaxMessageAge > 0 && age > o.cfg.MaxMessageAge {
+				if o.cfg.StaleAction == "drop" {
+					messagesDropped.WithLabelValues("stale").Inc()
+					slog.Debug("Reading older than MAX_MESSAGE_AGE, dropping it", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "age", age)
+					return
+				}
+				data.Stale = true
+				if o.cfg.StaleAction == "archive" {
+					data.Collection = o.cfg.StaleCollection
+				}
+			}
+		} else {
+			slog.Debug("No usable device timestamp, using server time", "component", "mqtt", "device_id", deviceID, "field", o.cfg.TimestampField)
+		}
+	}
+	data.Timestamp = data.Timestamp.Truncate(o.cfg.TimestampPrecision)
+	data.ReceivedAt = data.ReceivedAt.Truncate(o.cfg.TimestampPrecision)
+	// Rollups cover every reading, including those sampling drops.
+	if o.rollups != nil && doc != nil {
+		o.rollups.add(deviceID, data.Timestamp, doc)
+	}
+	data.ack, ack = ack, nil
+	data.lost = msg.lost
+	if o.dedup != nil {
+		payload := msg.Payload
+		data.forget = func() { o.dedup.forget(deviceID, payload) }
+	}
+	if o.sampler != nil {
+		if interval := o.sampleInterval(msg.Topic); interval > 0 {
+			store, ended := o.sampler.sample(data, doc, msg.Topic, interval, received)
+			if ended != nil {
+				o.storeSample(ended)
+			}
+			if !store {
+				return
+			}
+		}
+	}
+	slog.Debug("Received message", "component", "mqtt", "device_id", deviceID, "message_id", messageID, "topic", msg.Topic, "payload", data.Payload)
+	o.Store(ctx, data)
+	slog.Debug("Processed message", "component", "mqtt", "device_id", deviceID, "topic", msg.Topic, "latency_ms", time.Since(received).Milliseconds())
+}
+
+// newMessageID returns a random (version 4) UUID.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// parseJSONPayload decodes payload as a JSON object. It returns nil when the
+// payload is not one, in which case only the raw string is stored.
+func parseJSONPayload(payload []byte) map[string]interface{} {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil
+	}
+	return doc
+}
+
+// parseJSONValue decodes payload as any JSON value. Objects are returned as
+// map[string]interface{}, arrays as []interface{} and numbers as float64;
+// null is returned as nil.
+func parseJSONValue(payload []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// payloadTimestamp reads field from a decoded JSON payload as an RFC 3339
+// string or a Unix epoch in seconds or milliseconds (numeric or string).
+func payloadTimestamp(doc map[string]interface{}, field string) (time.Time, bool) {
+	switch v := doc[field].(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return epochTime(n)
+		}
+	case float64:
+		return epochTime(v)
+	}
+	return time.Time{}, false
+}
+
+// epochTime converts seconds, or milliseconds for values too large to be
+// plausible seconds, since the Unix epoch.
+func epochTime(n float64) (time.Time, bool) {
+	if n <= 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return time.Time{}, false
+	}
+	if n >= 1e11 {
+		return time.UnixMilli(int64(n)), true
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
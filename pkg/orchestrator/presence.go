@@ -0,0 +1,164 @@
+// presence.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+)
+
+// presenceTracker marks devices offline once they have not published for
+// OFFLINE_TIMEOUT, and online again on their next reading. Changes are
+// written to PRESENCE_COLLECTION and published under PRESENCE_TOPIC_PREFIX.
+type presenceTracker struct {
+	timeout time.Duration
+	// report is called with every change, outside the lock.
+	report func(PresenceStatus)
+
+	mu      sync.Mutex
+	devices map[string]*devicePresence
+}
+
+type devicePresence struct {
+	lastSeen time.Time
+	online   bool
+}
+
+// PresenceStatus is the presence document and MQTT status message of a
+// device.
+type PresenceStatus struct {
+	DeviceID  string    `json:"device_id" bson:"device_id"`
+	Status    string    `json:"status" bson:"status"`
+	LastSeen  time.Time `json:"last_seen" bson:"last_seen"`
+	ChangedAt time.Time `json:"changed_at" bson:"changed_at"`
+}
+
+func (o *Orchestrator) startPresenceTracker(ctx context.Context) {
+	if o.cfg.OfflineTimeout == 0 {
+		close(o.presenceDone)
+		return
+	}
+	o.presence = &presenceTracker{
+		timeout: o.cfg.OfflineTimeout,
+		report:  o.reportPresence,
+		devices: make(map[string]*devicePresence),
+	}
+
+	interval := o.cfg.OfflineTimeout / 2
+	go func() {
+		defer close(o.presenceDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				o.presence.scan(now)
+			}
+		}
+	}()
+	slog.Info("Tracking device presence", "component", "presence", "offline_timeout", o.cfg.OfflineTimeout)
+}
+
+// ensurePresenceIndex creates the unique device_id index of
+// PRESENCE_COLLECTION, so concurrent upserts cannot create two documents for
+// one device.
+func (o *Orchestrator) ensurePresenceIndex() error {
+	o.mongoMu.RLock()
+	collection := o.presenceCollection
+	o.mongoMu.RUnlock()
+
+	if collection == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "device_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("create index on %s: %w", collection.Name(), err)
+	}
+	return nil
+}
+
+// seen records a reading from the device and reports it online if it was
+// offline or unknown.
+func (p *presenceTracker) seen(deviceID string, now time.Time) {
+	p.mu.Lock()
+	d, ok := p.devices[deviceID]
+	if !ok {
+		d = &devicePresence{}
+		p.devices[deviceID] = d
+	}
+	d.lastSeen = now
+	changed := !d.online
+	d.online = true
+	p.mu.Unlock()
+
+	if changed {
+		// Off the message path, so a slow broker or database does not delay
+		// the reading.
+		go p.report(PresenceStatus{DeviceID: deviceID, Status: presenceOnline, LastSeen: now, ChangedAt: now})
+	}
+}
+
+// scan marks devices offline that have been silent for OFFLINE_TIMEOUT.
+func (p *presenceTracker) scan(now time.Time) {
+	var offline []PresenceStatus
+	p.mu.Lock()
+	for id, d := range p.devices {
+		if d.online && now.Sub(d.lastSeen) >= p.timeout {
+			d.online = false
+			offline = append(offline, PresenceStatus{DeviceID: id, Status: presenceOffline, LastSeen: d.lastSeen, ChangedAt: now})
+		}
+	}
+	p.mu.Unlock()
+
+	for _, status := range offline {
+		p.report(status)
+	}
+}
+
+func (o *Orchestrator) reportPresence(status PresenceStatus) {
+	slog.Info("Device presence changed", "component", "presence", "device_id", status.DeviceID, "status", status.Status, "last_seen", status.LastSeen)
+	if o.cfg.DryRun {
+		return
+	}
+
+	o.mongoMu.RLock()
+	collection := o.presenceCollection
+	o.mongoMu.RUnlock()
+	if collection != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), o.cfg.MongoInsertTimeout)
+		defer cancel()
+		_, err := collection.ReplaceOne(ctx, bson.M{"device_id": status.DeviceID}, status, options.Replace().SetUpsert(true))
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			slog.Error("Presence update failed", "component", "presence", "device_id", status.DeviceID, "error", err)
+		}
+	}
+
+	if o.cfg.PresenceTopicPrefix != "" && o.client != nil {
+		topic := o.cfg.PresenceTopicPrefix + "/" + status.DeviceID
+		if err := o.client.Publish(topic, o.cfg.LWTQoS, true, status.Status); err != nil {
+			slog.Warn("Presence publish failed", "component", "presence", "topic", topic, "error", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// ratelimit.go
+package orchestrator
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxRateLimitDevices bounds the bucket map; once it is exceeded, buckets
+// that have refilled completely are forgotten since they carry no state.
+const maxRateLimitDevices = 10000
+
+// rateLimiter is a token bucket per device ID.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// limited is set while the device is over its limit, so the warning is
+	// logged once per episode instead of once per dropped message.
+	limited bool
+}
+
+func (o *Orchestrator) openRateLimiter() {
+	if o.cfg.RateLimit == 0 {
+		return
+	}
+	o.limiter.Store(newRateLimiter(o.cfg.RateLimit, o.cfg.RateBurst))
+	slog.Info("Rate limiting enabled", "component", "ratelimit", "rate", o.cfg.RateLimit, "burst", o.cfg.RateBurst)
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// setRateLimit applies reloaded limits. Devices keep their buckets, which
+// are capped at the new burst as they refill.
+func (o *Orchestrator) setRateLimit(rate float64, burst int) {
+	switch l := o.limiter.Load(); {
+	case rate == 0:
+		o.limiter.Store(nil)
+		slog.Info("Rate limiting disabled", "component", "ratelimit")
+		return
+	case l == nil:
+		o.limiter.Store(newRateLimiter(rate, burst))
+	default:
+		l.mu.Lock()
+		l.rate, l.burst = rate, float64(burst)
+		l.mu.Unlock()
+	}
+	slog.Info("Rate limits updated", "component", "ratelimit", "rate", rate, "burst", burst)
+}
+
+// allow takes a token from the device's bucket and reports whether there was
+// one.
+func (l *rateLimiter) allow(deviceID string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[deviceID]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitDevices {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[deviceID] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		if !b.limited {
+			slog.Warn("Device exceeded rate limit, dropping readings", "component", "ratelimit", "device_id", deviceID, "rate", l.rate, "burst", l.burst)
+		}
+		b.limited = true
+		return false
+	}
+	if b.limited {
+		slog.Info("Device back under rate limit", "component", "ratelimit", "device_id", deviceID)
+	}
+	b.limited = false
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) prune(now time.Time) {
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
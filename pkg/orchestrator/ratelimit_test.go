@@ -0,0 +1,74 @@
+// ratelimit_test.go
+package orchestrator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		at     time.Duration
+		device string
+		want   bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst then limited",
+			rate:  1,
+			burst: 2,
+			steps: []step{
+				{at: 0, device: "a", want: true},
+				{at: 0, device: "a", want: true},
+				{at: 0, device: "a", want: false},
+			},
+		},
+		{
+			name:  "refills at rate",
+			rate:  2,
+			burst: 1,
+			steps: []step{
+				{at: 0, device: "a", want: true},
+				{at: 100 * time.Millisecond, device: "a", want: false},
+				{at: 500 * time.Millisecond, device: "a", want: true},
+				{at: 600 * time.Millisecond, device: "a", want: false},
+			},
+		},
+		{
+			name:  "refill capped at burst",
+			rate:  10,
+			burst: 1,
+			steps: []step{
+				{at: 0, device: "a", want: true},
+				{at: time.Hour, device: "a", want: true},
+				{at: time.Hour, device: "a", want: false},
+			},
+		},
+		{
+			name:  "buckets per device",
+			rate:  1,
+			burst: 1,
+			steps: []step{
+				{at: 0, device: "a", want: true},
+				{at: 0, device: "a", want: false},
+				{at: 0, device: "b", want: true},
+			},
+		},
+	}
+	start := time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			for i, s := range tt.steps {
+				if got := l.allow(s.device, start.Add(s.at)); got != s.want {
+					t.Errorf("step %d: allow(%s) at %s = %v, want %v", i, s.device, s.at, got, s.want)
+				}
+			}
+		})
+	}
+}
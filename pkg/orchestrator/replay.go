@@ -0,0 +1,150 @@
+// replay.go
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunReplay implements "orchestrator replay": it reprocesses the DLQ or the
+// disk buffer once, without connecting to the broker, and returns the exit
+// code. args are the command-line arguments after "replay".
+func RunReplay(cfg Config, args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	source := flags.String("source", "", "records to replay: dlq or buffer")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if cfg.DryRun {
+		fmt.Fprintln(os.Stderr, "replay: not supported with DRY_RUN")
+		return 2
+	}
+	if cfg.StorageBackend != "mongo" {
+		fmt.Fprintln(os.Stderr, "replay: requires STORAGE_BACKEND=mongo")
+		return 2
+	}
+
+	o := newOrchestrator(cfg)
+	var replay func(context.Context) (int, int, error)
+	switch *source {
+	case "dlq":
+		if cfg.DLQCollection == "" {
+			fmt.Fprintln(os.Stderr, "replay: DLQ_COLLECTION is not set")
+			return 2
+		}
+		replay = o.replayDeadLetters
+	case "buffer":
+		if cfg.BufferPath == "" {
+			fmt.Fprintln(os.Stderr, "replay: BUFFER_PATH is not set")
+			return 2
+		}
+		replay = o.replayBuffer
+	default:
+		fmt.Fprintf(os.Stderr, "replay: --source must be dlq or buffer, got %q\n", *source)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := o.openStore(); err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	defer o.store.Close(context.Background())
+	o.initCipherClient()
+	if err := o.connectMongo(ctx); err != nil {
+		slog.Info("Replay interrupted before connecting to MongoDB", "component", "replay", "source", *source)
+		return 1
+	}
+
+	succeeded, failed, err := replay(ctx)
+	if err != nil {
+		slog.Error("Replay failed", "component", "replay", "source", *source, "succeeded", succeeded, "failed", failed, "error", err)
+		return 1
+	}
+	slog.Info("Replay finished", "component", "replay", "source", *source, "succeeded", succeeded, "failed", failed, "interrupted", ctx.Err() != nil)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayDeadLetters retries every dead letter that the periodic retrier
+// would, oldest first. Entries that fail again stay in the DLQ with their
+// retry count bumped.
+func (o *Orchestrator) replayDeadLetters(ctx context.Context) (succeeded, failed int, err error) {
+	o.mongoMu.RLock()
+	collection := o.dlqCollection
+	o.mongoMu.RUnlock()
+
+	opts := options.Find().SetSort(bson.D{{Key: "failed_at", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"stage": retryableStages}, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var entry DeadLetter
+		if err := cursor.Decode(&entry); err != nil {
+			slog.Warn("Skipping undecodable entry", "component", "replay", "error", err)
+			failed++
+			continue
+		}
+		if o.retryDeadLetter(entry) {
+			succeeded++
+		} else {
+			failed++
+		}
+	}
+	if err := cursor.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return succeeded, failed, err
+	}
+	return succeeded, failed, nil
+}
+
+// replayBuffer inserts every buffered reading. Readings that fail, other than
+// those MongoDB rejects, which go to the DLQ, and those not reached before a
+// signal are written back to the buffer.
+func (o *Orchestrator) replayBuffer(ctx context.Context) (succeeded, failed int, err error) {
+	if err := o.openDiskBuffer(); err != nil {
+		return 0, 0, err
+	}
+	records, err := o.diskBuf.take()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var keep []SensorData
+	for start := 0; start < len(records); start += o.cfg.BatchSize {
+		if ctx.Err() != nil {
+			keep = append(keep, records[start:]...)
+			break
+		}
+		chunk := records[start:min(start+o.cfg.BatchSize, len(records))]
+		stored, kept, err := o.replayGroups(chunk)
+		if err != nil {
+			slog.Warn("Batch failed, keeping it buffered", "component", "replay", "records", len(kept), "error", err)
+		}
+		o.storeLatest(stored)
+		keep = append(keep, kept...)
+		succeeded += len(stored)
+		failed += len(chunk) - len(stored)
+	}
+
+	if len(keep) > 0 {
+		o.diskBuf.append(keep)
+	}
+	os.Remove(o.diskBuf.replayPath())
+	return succeeded, failed, nil
+}
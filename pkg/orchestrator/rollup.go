@@ -0,0 +1,230 @@
+// rollup.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rollupAggregator accumulates the numeric fields of JSON payloads per device
+// and ROLLUP_INTERVAL window, by reading timestamp. Windows are written to
+// ROLLUP_COLLECTION once they end.
+type rollupAggregator struct {
+	interval time.Duration
+	// encrypted are the ENCRYPT_FIELDS, which are not rolled up since the
+	// rollups are stored in plaintext.
+	encrypted []string
+
+	mu      sync.Mutex
+	buckets map[rollupKey]*rollupBucket
+}
+
+type rollupKey struct {
+	device string
+	start  int64
+}
+
+type rollupBucket struct {
+	device string
+	start  time.Time
+	count  int
+	fields map[string]*rollupStats
+}
+
+type rollupStats struct {
+	min, max, sum float64
+	count         int
+}
+
+func (o *Orchestrator) openRollups() {
+	if o.cfg.RollupInterval == 0 {
+		return
+	}
+	o.rollups = &rollupAggregator{
+		interval:  o.cfg.RollupInterval,
+		encrypted: o.cfg.EncryptFields,
+		buckets:   make(map[rollupKey]*rollupBucket),
+	}
+	slog.Info("Rolling up readings", "component", "rollup", "interval", o.cfg.RollupInterval, "collection", o.cfg.RollupCollection)
+}
+
+// add folds the numeric top-level fields of doc into the window of ts.
+// Fields whose names cannot be used in an update path are skipped.
+func (r *rollupAggregator) add(device string, ts time.Time, doc map[string]interface{}) {
+	start := ts.Truncate(r.interval)
+	key := rollupKey{device: device, start: start.UnixNano()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rollupBucket{device: device, start: start, fields: make(map[string]*rollupStats)}
+		r.buckets[key] = b
+	}
+	b.count++
+	for field, v := range doc {
+		n, ok := v.(float64)
+		if !ok || strings.Contains(field, ".") || strings.HasPrefix(field, "$") || slices.Contains(r.encrypted, field) {
+			continue
+		}
+		s, ok := b.fields[field]
+		if !ok {
+			b.fields[field] = &rollupStats{min: n, max: n, sum: n, count: 1}
+			continue
+		}
+		s.min = min(s.min, n)
+		s.max = max(s.max, n)
+		s.sum += n
+		s.count++
+	}
+}
+
+// due removes and returns the windows that ended by now, or all of them when
+// all is set.
+func (r *rollupAggregator) due(now time.Time, all bool) []*rollupBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ended []*rollupBucket
+	for key, b := range r.buckets {
+		if all || !now.Before(b.start.Add(r.interval)) {
+			delete(r.buckets, key)
+			ended = append(ended, b)
+		}
+	}
+	return ended
+}
+
+// startRollupFlusher writes the windows that have ended at every interval
+// boundary. The window still open at shutdown is written by shutdown.
+func (o *Orchestrator) startRollupFlusher(ctx context.Context) {
+	if o.rollups == nil {
+		close(o.rollupDone)
+		return
+	}
+	interval := o.cfg.RollupInterval
+	go func() {
+		defer close(o.rollupDone)
+		for {
+			now := time.Now()
+			timer := time.NewTimer(now.Truncate(interval).Add(interval).Sub(now))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case now := <-timer.C:
+				o.writeRollups(o.rollups.due(now, false))
+			}
+		}
+	}()
+}
+
+// flushRollups writes every window still held, complete or not.
+func (o *Orchestrator) flushRollups() {
+	if o.rollups == nil {
+		return
+	}
+	o.writeRollups(o.rollups.due(time.Time{}, true))
+}
+
+// writeRollups merges buckets into their ROLLUP_COLLECTION documents. A
+// window can be written more than once, by late readings or by several
+// replicas, so min, max, sum and count are combined with what is stored and
+// avg is recomputed from them. Rollups that fail to write are dropped.
+func (o *Orchestrator) writeRollups(buckets []*rollupBucket) {
+	if len(buckets) == 0 {
+		return
+	}
+	if o.cfg.DryRun {
+		slog.Info("Dry run, not storing rollups", "component", "rollup", "windows", len(buckets))
+		return
+	}
+
+	o.mongoMu.RLock()
+	collection := o.rollupCollection
+	o.mongoMu.RUnlock()
+	if collection == nil {
+		slog.Error("Rollup write failed", "component", "rollup", "windows", len(buckets), "error", "not connected to MongoDB")
+		return
+	}
+
+	models := make([]mongo.WriteModel, len(buckets))
+	for i, b := range buckets {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "device_id", Value: b.device}, {Key: "start", Value: b.start}}).
+			SetUpdate(b.update(o.cfg.RollupInterval)).
+			SetUpsert(true)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.cfg.MongoInsertTimeout)
+	defer cancel()
+	if _, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		slog.Error("Rollup write failed", "component", "rollup", "windows", len(buckets), "error", err)
+		return
+	}
+	slog.Debug("Stored rollups", "component", "rollup", "windows", len(buckets))
+}
+
+// update returns the update pipeline merging b into its stored document.
+func (b *rollupBucket) update(interval time.Duration) mongo.Pipeline {
+	merge := bson.D{
+		{Key: "end", Value: b.start.Add(interval)},
+		{Key: "count", Value: addTo("$count", b.count)},
+	}
+	var averages bson.D
+	for field, s := range b.fields {
+		path := "fields." + field
+		merge = append(merge,
+			bson.E{Key: path + ".min", Value: bson.M{"$min": bson.A{"$" + path + ".min", s.min}}},
+			bson.E{Key: path + ".max", Value: bson.M{"$max": bson.A{"$" + path + ".max", s.max}}},
+			bson.E{Key: path + ".sum", Value: addTo("$"+path+".sum", s.sum)},
+			bson.E{Key: path + ".count", Value: addTo("$"+path+".count", s.count)},
+		)
+		averages = append(averages, bson.E{Key: path + ".avg", Value: bson.M{"$divide": bson.A{"$" + path + ".sum", "$" + path + ".count"}}})
+	}
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: merge}}}
+	if len(averages) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$set", Value: averages}})
+	}
+	return pipeline
+}
+
+// addTo is the expression adding n to the stored value at path, 0 if unset.
+func addTo(path string, n any) bson.M {
+	return bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{path, 0}}, n}}
+}
+
+// ensureRollupIndex creates the unique {device_id, start} index of
+// ROLLUP_COLLECTION, so concurrent upserts of a window cannot create two
+// documents.
+func (o *Orchestrator) ensureRollupIndex() error {
+	o.mongoMu.RLock()
+	collection := o.rollupCollection
+	o.mongoMu.RUnlock()
+
+	if collection == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "device_id", Value: 1}, {Key: "start", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("create index on %s: %w", collection.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+// sample.go
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSampleKeys bounds the window map in drop mode; beyond it, windows that
+// have ended are forgotten.
+const maxSampleKeys = 10000
+
+// sampleRoute sets the SAMPLE_INTERVAL of topics matching Filter.
+type sampleRoute struct {
+	Filter   string
+	Interval time.Duration
+}
+
+// parseSampleRoutes parses a JSON object such as
+// {"factory/+/vibration": "1s", "alerts/#": "0"}. The first matching filter
+// wins, so key order is kept; "0" turns sampling off for those topics.
+func parseSampleRoutes(v string) ([]sampleRoute, error) {
+	dec := json.NewDecoder(strings.NewReader(v))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("must be a JSON object of topic filter to interval")
+	}
+	var routes []sampleRoute
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var s string
+		if err := dec.Decode(&s); err != nil {
+			return nil, fmt.Errorf("filter %q: interval must be a string", tok)
+		}
+		interval, err := time.ParseDuration(s)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("filter %q: %q is not a valid interval", tok, s)
+		}
+		routes = append(routes, sampleRoute{Filter: tok.(string), Interval: interval})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// sampler keeps at most one reading per device and topic per interval. In
+// "drop" mode that is the first reading of the interval; in "average" mode
+// the first reading is held until the interval ends and then stored with its
+// numeric JSON fields averaged over every reading of the interval.
+type sampler struct {
+	mu      sync.Mutex
+	average bool
+	windows map[string]*sampleWindow
+	// closed is set by flush at shutdown; readings then pass unsampled so
+	// none are held once the batch writer stops.
+	closed bool
+	// inflight is the orchestrator's; a held reading counts as in flight
+	// until it is stored.
+	inflight *sync.WaitGroup
+}
+
+type sampleWindow struct {
+	end time.Time
+	// The fields below are only used in average mode.
+	data   SensorData
+	doc    map[string]interface{}
+	sums   map[string]float64
+	counts map[string]int
+	n      int
+}
+
+func (o *Orchestrator) openSampler() {
+	if o.cfg.SampleInterval == 0 && len(o.cfg.SampleRoutes) == 0 {
+		return
+	}
+	o.sampler = &sampler{
+		average:  o.cfg.SampleMode == "average",
+		windows:  make(map[string]*sampleWindow),
+		inflight: &o.inflight,
+	}
+	slog.Info("Sampling enabled", "component", "sample", "interval", o.cfg.SampleInterval, "mode", o.cfg.SampleMode)
+}
+
+// sampleInterval returns the interval for topic, 0 if it is not sampled.
+func (o *Orchestrator) sampleInterval(topic string) time.Duration {
+	for _, route := range o.cfg.SampleRoutes {
+		if topicMatches(route.Filter, topic) {
+			return route.Interval
+		}
+	}
+	return o.cfg.SampleInterval
+}
+
+// sample reports whether data should be stored now. In average mode a
+// reading that starts an interval is held, and the previous window, if its
+// interval has ended, is returned as ended, to be stored first. doc is the decoded payload
+// of data, nil if it is not a JSON object.
+func (s *sampler) sample(data SensorData, doc map[string]interface{}, topic string, interval time.Duration, now time.Time) (store bool, ended *sampleWindow) {
+	key := data.DeviceID + "\x00" + topic
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return true, nil
+	}
+	w, ok := s.windows[key]
+	if ok && now.Before(w.end) {
+		if s.average {
+			w.add(doc)
+		}
+		messagesDropped.WithLabelValues("sampled").Inc()
+		data.acknowledge()
+		return false, nil
+	}
+	if !s.average {
+		if !ok && len(s.windows) >= maxSampleKeys {
+			s.prune(now)
+		}
+		s.windows[key] = &sampleWindow{end: now.Add(interval)}
+		return true, nil
+	}
+
+	if ok {
+		ended = w
+	}
+	w = &sampleWindow{end: now.Add(interval), data: data, doc: doc}
+	w.add(doc)
+	s.windows[key] = w
+	s.inflight.Add(1)
+	return false, ended
+}
+
+func (s *sampler) prune(now time.Time) {
+	for key, w := range s.windows {
+		if !now.Before(w.end) {
+			delete(s.windows, key)
+		}
+	}
+}
+
+// expired removes and returns the average-mode windows that have ended.
+func (s *sampler) expired(now time.Time) []*sampleWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ended []*sampleWindow
+	for key, w := range s.windows {
+		if !now.Before(w.end) {
+			delete(s.windows, key)
+			ended = append(ended, w)
+		}
+	}
+	return ended
+}
+
+// flush removes and returns every held window and lets later readings pass.
+func (s *sampler) flush() []*sampleWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var held []*sampleWindow
+	if s.average {
+		for _, w := range s.windows {
+			held = append(held, w)
+		}
+	}
+	s.windows = nil
+	return held
+}
+
+// add counts a reading of the interval and sums its numeric fields.
+func (w *sampleWindow) add(doc map[string]interface{}) {
+	w.n++
+	for field, v := range doc {
+		n, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if w.sums == nil {
+			w.sums = make(map[string]float64)
+			w.counts = make(map[string]int)
+		}
+		w.sums[field] += n
+		w.counts[field]++
+	}
+}
+
+// reading returns the held reading with its numeric fields replaced by their
+// averages. It keeps the timestamp of the first reading of the interval.
+func (w *sampleWindow) reading() SensorData {
+	data := w.data
+	data.Samples = w.n
+	if w.doc == nil || w.n == 1 {
+		return data
+	}
+	for field, sum := range w.sums {
+		avg := sum / float64(w.counts[field])
+		w.doc[field] = avg
+		if _, ok := data.Fields[field]; ok {
+			data.Fields[field] = avg
+		}
+	}
+	if payload, err := json.Marshal(w.doc); err == nil {
+		data.Payload = string(payload)
+	}
+	if data.PayloadJSON != nil {
+		data.PayloadJSON = w.doc
+	}
+	return data
+}
+
+// startSampleFlusher stores average-mode readings once their interval ends,
+// checking every tick.
+func (o *Orchestrator) startSampleFlusher(ctx context.Context) {
+	if o.sampler == nil || !o.sampler.average {
+		return
+	}
+	tick := time.Second
+	for _, interval := range o.sampleIntervals() {
+		tick = min(tick, interval)
+	}
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, w := range o.sampler.expired(now) {
+					o.storeSample(w)
+				}
+			}
+		}
+	}()
+}
+
+// sampleIntervals returns the non-zero intervals configured.
+func (o *Orchestrator) sampleIntervals() []time.Duration {
+	var intervals []time.Duration
+	if o.cfg.SampleInterval > 0 {
+		intervals = append(intervals, o.cfg.SampleInterval)
+	}
+	for _, route := range o.cfg.SampleRoutes {
+		if route.Interval > 0 {
+			intervals = append(intervals, route.Interval)
+		}
+	}
+	return intervals
+}
+
+// flushSamples stores the readings still held at shutdown.
+func (o *Orchestrator) flushSamples() {
+	if o.sampler == nil {
+		return
+	}
+	held := o.sampler.flush()
+	for _, w := range held {
+		o.storeSample(w)
+	}
+	if len(held) > 0 {
+		slog.Info("Stored held samples", "component", "sample", "readings", len(held))
+	}
+}
+
+// storeSample stores the reading of an ended average-mode window and releases
+// its inflight slot.
+func (o *Orchestrator) storeSample(w *sampleWindow) {
+	defer o.inflight.Done()
+	data := w.reading()
+	if doc, ok := data.PayloadJSON.(map[string]interface{}); ok {
+		data.PayloadJSON = o.payloadJSON(doc)
+	}
+	o.Store(o.workCtx, data)
+}
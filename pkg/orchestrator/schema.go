@@ -0,0 +1,33 @@
+// schema.go
+package orchestrator
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+func (o *Orchestrator) loadSchema() error {
+	if o.cfg.SchemaPath == "" {
+		return nil
+	}
+	schema, err := jsonschema.NewCompiler().Compile(o.cfg.SchemaPath)
+	if err != nil {
+		return fmt.Errorf("load schema: %w", err)
+	}
+	o.payloadSchema = schema
+	slog.Info("Validating payloads", "component", "schema", "path", o.cfg.SchemaPath, "invalid_action", o.cfg.SchemaInvalidAction)
+	return nil
+}
+
+// validatePayload checks payload against the schema. Payloads that are not
+// JSON fail validation.
+func (o *Orchestrator) validatePayload(payload []byte) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	return o.payloadSchema.Validate(inst)
+}
@@ -0,0 +1,78 @@
+// serverversion.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoFeature is a setting that needs at least version Major.Minor of the
+// MongoDB server.
+type mongoFeature struct {
+	Setting      string
+	Enabled      bool
+	Major, Minor int32
+}
+
+// checkServerVersion logs the version of the MongoDB server and checks it
+// against the settings in use. Unsupported settings are logged, and with
+// MONGO_VERSION_CHECK=fail returned as an error, before they fail in
+// confusing ways at index setup or on the first write.
+func (o *Orchestrator) checkServerVersion() error {
+	if o.cfg.MongoVersionCheck == "off" {
+		return nil
+	}
+
+	o.mongoMu.RLock()
+	db := o.mongoDatabase
+	o.mongoMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var info struct {
+		Version      string  `bson:"version"`
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		if o.cfg.MongoVersionCheck == "fail" {
+			return fmt.Errorf("query MongoDB server version: %w", err)
+		}
+		slog.Warn("Failed to query the server version", "component", "mongodb", "error", err)
+		return nil
+	}
+	slog.Info("MongoDB server", "component", "mongodb", "version", info.Version)
+
+	features := []mongoFeature{
+		{Setting: "TIMESERIES", Enabled: o.cfg.TimeSeries, Major: 5, Minor: 0},
+		// Rollups are merged with update pipelines.
+		{Setting: "ROLLUP_INTERVAL", Enabled: o.cfg.RollupInterval != 0, Major: 4, Minor: 2},
+	}
+	var unsupported []string
+	for _, f := range features {
+		if !f.Enabled || versionAtLeast(info.VersionArray, f.Major, f.Minor) {
+			continue
+		}
+		unsupported = append(unsupported, fmt.Sprintf("%s requires %d.%d", f.Setting, f.Major, f.Minor))
+		slog.Warn("Setting not supported by the server", "component", "mongodb", "setting", f.Setting, "version", info.Version, "required", fmt.Sprintf("%d.%d", f.Major, f.Minor))
+	}
+	if len(unsupported) > 0 && o.cfg.MongoVersionCheck == "fail" {
+		return fmt.Errorf("MongoDB %s: %s", info.Version, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// versionAtLeast reports whether a buildInfo versionArray is major.minor or
+// later.
+func versionAtLeast(version []int32, major, minor int32) bool {
+	for len(version) < 2 {
+		version = append(version, 0)
+	}
+	return slices.Compare(version[:2], []int32{major, minor}) >= 0
+}
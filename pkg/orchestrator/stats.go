@@ -0,0 +1,84 @@
+// stats.go
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ingestStats is published to STATS_TOPIC. The counters are totals since
+// startup, taken from the Prometheus metrics.
+type ingestStats struct {
+	Received      uint64    `json:"received"`
+	Stored        uint64    `json:"stored"`
+	Failed        uint64    `json:"failed"`
+	Dropped       uint64    `json:"dropped"`
+	Duplicates    uint64    `json:"duplicates"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func (o *Orchestrator) startStatsPublisher(ctx context.Context) {
+	if o.cfg.StatsTopic == "" {
+		return
+	}
+	started := time.Now()
+	go func() {
+		ticker := time.NewTicker(o.cfg.StatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				o.publishStats(started, now)
+			}
+		}
+	}()
+	slog.Info("Stats publisher started", "component", "stats", "topic", o.cfg.StatsTopic, "interval", o.cfg.StatsInterval)
+}
+
+func (o *Orchestrator) publishStats(started, now time.Time) {
+	stats := ingestStats{
+		Received:      counterTotal(messagesReceived),
+		Stored:        counterTotal(mongoInserts),
+		Failed:        counterTotal(mongoInsertFailures),
+		Dropped:       counterTotal(messagesDropped),
+		Duplicates:    counterTotal(messagesDuplicate),
+		UptimeSeconds: int64(now.Sub(started).Seconds()),
+		Timestamp:     now.UTC(),
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	if !o.client.IsConnected() {
+		slog.Debug("Skipping stats, broker disconnected", "component", "stats")
+		return
+	}
+	if err := o.client.Publish(o.cfg.StatsTopic, 0, false, string(body)); err != nil {
+		slog.Warn("Stats publish failed", "component", "stats", "topic", o.cfg.StatsTopic, "error", err)
+	}
+}
+
+// counterTotal sums a counter, or every series of a counter vector.
+func counterTotal(c prometheus.Collector) uint64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var total float64
+	for m := range ch {
+		var pb dto.Metric
+		if m.Write(&pb) == nil && pb.Counter != nil {
+			total += pb.Counter.GetValue()
+		}
+	}
+	return uint64(total)
+}
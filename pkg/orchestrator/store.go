@@ -0,0 +1,177 @@
+// store.go
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Store is the backend readings are written to, selected by STORAGE_BACKEND.
+// The batch writer, the disk buffer replay and the DLQ retrier all go through
+// it.
+type Store interface {
+	// Insert stores a single reading.
+	Insert(ctx context.Context, data SensorData) error
+	// InsertMany stores readings bound for the same collection. A failure
+	// may leave some of them stored; MongoDB reports which ones in a
+	// mongo.BulkWriteException.
+	InsertMany(ctx context.Context, batch []SensorData) error
+	// Ping reports whether the backend can currently accept writes.
+	Ping(ctx context.Context) error
+	// Close flushes and releases the backend.
+	Close(ctx context.Context) error
+}
+
+// openStore sets up the configured backend. MongoDB is only connected to
+// later, by connectMongo.
+func (o *Orchestrator) openStore() error {
+	switch o.cfg.StorageBackend {
+	case "file":
+		s, err := newFileStore(o.cfg.StorageFile)
+		if err != nil {
+			return fmt.Errorf("open storage file: %w", err)
+		}
+		o.store = s
+	default:
+		o.store = &mongoStore{o: o}
+	}
+	slog.Info("Storage backend selected", "component", "store", "backend", o.cfg.StorageBackend)
+	if o.cfg.KafkaEnable {
+		o.store = &teeStore{Store: o.store, mirrors: []Store{newKafkaStore(o.cfg.KafkaBrokers, o.cfg.KafkaTopic)}}
+		slog.Info("Mirroring readings to Kafka", "component", "kafka", "brokers", o.cfg.KafkaBrokers, "topic", o.cfg.KafkaTopic)
+	}
+	return nil
+}
+
+// ensureStoreAvailable checks the backend before buffered readings are
+// replayed, making a reconnect attempt for MongoDB.
+func (o *Orchestrator) ensureStoreAvailable() error {
+	primary := o.store
+	if tee, ok := primary.(*teeStore); ok {
+		primary = tee.Store
+	}
+	if _, ok := primary.(*mongoStore); ok {
+		return o.ensureMongoConnected()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return o.store.Ping(ctx)
+}
+
+// teeStore writes readings to the storage backend, the embedded Store, and
+// then hands those it stored to the mirrors. The backend alone decides
+// whether a reading is stored, so readings that a mirror fails to take are
+// logged and not retried, and a reading retried after a partial failure may
+// reach a mirror more than once.
+type teeStore struct {
+	Store
+	mirrors []Store
+}
+
+func (s *teeStore) Insert(ctx context.Context, data SensorData) error {
+	err := s.Store.Insert(ctx, data)
+	s.mirror(ctx, storedReadings([]SensorData{data}, err))
+	return err
+}
+
+func (s *teeStore) InsertMany(ctx context.Context, batch []SensorData) error {
+	err := s.Store.InsertMany(ctx, batch)
+	s.mirror(ctx, storedReadings(batch, err))
+	return err
+}
+
+func (s *teeStore) mirror(ctx context.Context, stored []SensorData) {
+	if len(stored) == 0 {
+		return
+	}
+	for _, m := range s.mirrors {
+		if err := m.InsertMany(ctx, stored); err != nil {
+			slog.Error("Mirror write failed", "component", "store", "documents", len(stored), "error", err)
+		}
+	}
+}
+
+// Close closes the backend and then the mirrors, which may still be
+// publishing its last readings.
+func (s *teeStore) Close(ctx context.Context) error {
+	errs := []error{s.Store.Close(ctx)}
+	for _, m := range s.mirrors {
+		errs = append(errs, m.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// fileStore writes readings as JSON lines to a file, or to stdout for "-".
+// Collection routing does not apply; each line carries its "collection".
+type fileStore struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	f := os.Stdout
+	if path != "-" {
+		var err error
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fileStore{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *fileStore) Insert(ctx context.Context, data SensorData) error {
+	return s.InsertMany(ctx, []SensorData{data})
+}
+
+// InsertMany flushes once per batch rather than once per reading.
+func (s *fileStore) InsertMany(_ context.Context, batch []SensorData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("store closed")
+	}
+	enc := json.NewEncoder(s.w)
+	for _, data := range batch {
+		if err := enc.Encode(data); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *fileStore) Ping(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("store closed")
+	}
+	return nil
+}
+
+func (s *fileStore) Close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if s.file != os.Stdout {
+		if cerr := s.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,71 @@
+// timeseries.go
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureTimeSeriesCollection creates the named data collection as a
+// time-series collection (timeField timestamp, metaField device_id) unless it
+// already exists. It reports whether the collection is a time-series one; an
+// existing regular collection cannot be converted and is used as is.
+func (o *Orchestrator) ensureTimeSeriesCollection(name string) (bool, error) {
+	o.mongoMu.RLock()
+	db := o.mongoDatabase
+	o.mongoMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+	if err != nil {
+		return false, fmt.Errorf("list collections: %w", err)
+	}
+	if len(specs) > 0 {
+		if specs[0].Type != "timeseries" {
+			slog.Warn("Collection exists and is not a time-series collection, leaving it as is", "component", "mongodb", "collection", name)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	opts := options.CreateCollection().SetTimeSeriesOptions(options.TimeSeries().
+		SetTimeField("timestamp").
+		SetMetaField("device_id").
+		SetGranularity(o.cfg.TimeSeriesGranularity))
+	if o.cfg.DataRetention != 0 {
+		opts.SetExpireAfterSeconds(int64(o.cfg.DataRetention / time.Second))
+	}
+	if err := db.CreateCollection(ctx, name, opts); err != nil {
+		return false, fmt.Errorf("create time-series collection %s: %w", name, err)
+	}
+	slog.Info("Created time-series collection", "component", "mongodb", "collection", name, "granularity", o.cfg.TimeSeriesGranularity)
+	return true, nil
+}
+
+// ensureTimeSeriesExpiry sets the expiry of a time-series collection to
+// DATA_RETENTION. Time-series collections expire buckets through
+// expireAfterSeconds rather than a TTL index.
+func (o *Orchestrator) ensureTimeSeriesExpiry(collection *mongo.Collection) error {
+	if o.cfg.DataRetention == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	expireAfter := int64(o.cfg.DataRetention / time.Second)
+	cmd := bson.D{{Key: "collMod", Value: collection.Name()}, {Key: "expireAfterSeconds", Value: expireAfter}}
+	if err := collection.Database().RunCommand(ctx, cmd).Err(); err != nil {
+		return fmt.Errorf("set time-series expiry on %s: %w", collection.Name(), err)
+	}
+	slog.Info("Time-series expiry up to date", "component", "mongodb", "collection", collection.Name(), "expire_after_seconds", expireAfter)
+	return nil
+}
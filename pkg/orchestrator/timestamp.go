@@ -0,0 +1,51 @@
+// timestamp.go
+package orchestrator
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// parseTimestampPrecision parses TIMESTAMP_PRECISION into the unit timestamps
+// are truncated to.
+func parseTimestampPrecision(v string) (time.Duration, error) {
+	switch v {
+	case "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("%q must be ns, us, ms or s", v)
+}
+
+// dataCollectionOptions returns the options of the collections that hold
+// readings. With TIMESTAMP_FORMAT=epoch_ms their times, including those in
+// query filters, are encoded as Unix milliseconds instead of BSON dates, so
+// stored documents and queries stay consistent.
+func (o *Orchestrator) dataCollectionOptions() *options.CollectionOptions {
+	if o.cfg.TimestampFormat != "epoch_ms" {
+		return nil
+	}
+	return options.Collection().SetRegistry(epochMillisRegistry)
+}
+
+// epochMillisRegistry is the default BSON registry with time.Time encoded as
+// an int64. The default decoder already reads int64 values as milliseconds.
+var epochMillisRegistry = func() *bsoncodec.Registry {
+	reg := bson.NewRegistry()
+	reg.RegisterTypeEncoder(reflect.TypeOf(time.Time{}), bsoncodec.ValueEncoderFunc(
+		func(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+			return vw.WriteInt64(val.Interface().(time.Time).UnixMilli())
+		}))
+	return reg
+}()
@@ -0,0 +1,109 @@
+// topictemplate.go
+package orchestrator
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// topicTemplate maps topic levels to document fields, e.g.
+// "factory/{site}/{line}/{device}". Literal levels must match exactly and
+// every {name} level captures one level of the topic.
+type topicTemplate struct {
+	// levels holds the literal level, or "" where names has the field.
+	levels []string
+	names  []string
+}
+
+// templateTags are stored fields a template may fill, replacing the SITE,
+// GATEWAY_ID and ENV values for matching topics.
+var templateTags = map[string]bool{"site": true, "gateway_id": true, "environment": true}
+
+func parseTopicTemplate(v string) (*topicTemplate, error) {
+	t := &topicTemplate{}
+	seen := make(map[string]bool)
+	for _, level := range strings.Split(v, "/") {
+		if !strings.HasPrefix(level, "{") || !strings.HasSuffix(level, "}") {
+			if strings.ContainsAny(level, "{}+#") {
+				return nil, fmt.Errorf("level %q must be literal or a single {name}", level)
+			}
+			t.levels = append(t.levels, level)
+			t.names = append(t.names, "")
+			continue
+		}
+		name := level[1 : len(level)-1]
+		switch {
+		case name == "" || strings.ContainsAny(name, "{}"):
+			return nil, fmt.Errorf("level %q must be literal or a single {name}", level)
+		case storedFields[name] && !templateTags[name]:
+			return nil, fmt.Errorf("%q is a reserved field name", name)
+		case strings.HasPrefix(name, "$") || strings.Contains(name, "."):
+			return nil, fmt.Errorf("%q is not a valid field name", name)
+		case seen[name]:
+			return nil, fmt.Errorf("%q is used twice", name)
+		}
+		seen[name] = true
+		t.levels = append(t.levels, "")
+		t.names = append(t.names, name)
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("%q has no {name} levels", v)
+	}
+	return t, nil
+}
+
+// fields returns the names the template captures, in topic order.
+func (t *topicTemplate) fields() []string {
+	var fields []string
+	for _, name := range t.names {
+		if name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// match returns the captured levels of topic, or false if the topic does not
+// have the template's shape.
+func (t *topicTemplate) match(topic string) (map[string]string, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != len(t.levels) {
+		return nil, false
+	}
+	values := make(map[string]string, len(t.names))
+	for i, level := range levels {
+		if t.names[i] == "" {
+			if level != t.levels[i] {
+				return nil, false
+			}
+			continue
+		}
+		values[t.names[i]] = level
+	}
+	return values, true
+}
+
+// applyTopicTemplate stores the levels captured from topic on data.
+func (o *Orchestrator) applyTopicTemplate(data *SensorData, topic string) {
+	values, ok := o.cfg.TopicTemplate.match(topic)
+	if !ok {
+		slog.Warn("Topic does not match TOPIC_TEMPLATE", "component", "mqtt", "topic", topic)
+		return
+	}
+	for name, value := range values {
+		switch name {
+		case "site":
+			data.Site = value
+		case "gateway_id":
+			data.GatewayID = value
+		case "environment":
+			data.Environment = value
+		default:
+			if data.Fields == nil {
+				data.Fields = make(map[string]interface{}, len(values))
+			}
+			data.Fields[name] = value
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// transform.go
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// transformRules normalize JSON object payloads before storage. They apply to
+// top-level fields in this order: rename, scale, drop.
+type transformRules struct {
+	// Rename maps old field names to new ones.
+	Rename map[string]string `json:"rename"`
+	// Scale multiplies numeric fields by a factor.
+	Scale map[string]float64 `json:"scale"`
+	// Drop removes fields.
+	Drop []string `json:"drop"`
+}
+
+// parseTransformRules parses TRANSFORM_RULES, rejecting unknown rule types so
+// typos do not go unnoticed.
+func parseTransformRules(v string) (*transformRules, error) {
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	var rules transformRules
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	for from, to := range rules.Rename {
+		if from == "" || to == "" {
+			return nil, errors.New("rename: field names must not be empty")
+		}
+	}
+	return &rules, nil
+}
+
+// apply transforms doc in place.
+func (r *transformRules) apply(doc map[string]interface{}) {
+	for from, to := range r.Rename {
+		if v, ok := doc[from]; ok {
+			delete(doc, from)
+			doc[to] = v
+		}
+	}
+	for field, factor := range r.Scale {
+		if n, ok := doc[field].(float64); ok {
+			doc[field] = n * factor
+		}
+	}
+	for _, field := range r.Drop {
+		delete(doc, field)
+	}
+}
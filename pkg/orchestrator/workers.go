@@ -0,0 +1,92 @@
+// workers.go
+package orchestrator
+
+import (
+	"log/slog"
+)
+
+func (o *Orchestrator) startWorkers() {
+	if o.cfg.Workers == 0 {
+		return
+	}
+	o.workQueue = make(chan Message, o.cfg.WorkerQueueSize)
+	o.queueReaders.Add(o.cfg.Workers)
+	for i := 0; i < o.cfg.Workers; i++ {
+		go func() {
+			defer o.queueReaders.Done()
+			for msg := range o.workQueue {
+				workQueueLength.Dec()
+				o.HandleMessage(msg)
+				o.releaseInflight()
+				o.inflight.Done()
+			}
+		}()
+	}
+	slog.Info("Workers started", "component", "workers", "workers", o.cfg.Workers, "queue_size", o.cfg.WorkerQueueSize, "queue_full", o.cfg.QueueFullPolicy)
+}
+
+// dispatchMessage hands msg to the worker pool, or handles it inline when
+// there is none. A queued message holds an inflight slot until it is handled,
+// so shutdown waits for the queue to drain.
+func (o *Orchestrator) dispatchMessage(msg Message) {
+	if !o.acquireInflight(msg) {
+		return
+	}
+	if o.workQueue == nil {
+		defer o.releaseInflight()
+		o.HandleMessage(msg)
+		return
+	}
+
+	o.inflight.Add(1)
+	workQueueLength.Inc()
+	if o.cfg.QueueFullPolicy == "block" {
+		o.workQueue <- msg
+		return
+	}
+	select {
+	case o.workQueue <- msg:
+	default:
+		workQueueLength.Dec()
+		o.releaseInflight()
+		o.inflight.Done()
+		messagesDropped.WithLabelValues("queue_full").Inc()
+		slog.Warn("Work queue full, dropping message", "component", "workers", "topic", msg.Topic)
+		if msg.ack != nil {
+			msg.ack()
+		}
+	}
+}
+
+// acquireInflight takes a MAX_INFLIGHT slot for msg, waiting for one with
+// OVERFLOW_POLICY=block. It reports false if msg was dropped instead.
+func (o *Orchestrator) acquireInflight(msg Message) bool {
+	if o.inflightLimit == nil {
+		return true
+	}
+	if o.cfg.OverflowPolicy == "block" {
+		o.inflightLimit <- struct{}{}
+		inflightMessages.Inc()
+		return true
+	}
+	select {
+	case o.inflightLimit <- struct{}{}:
+		inflightMessages.Inc()
+		return true
+	default:
+		messagesDropped.WithLabelValues("inflight_limit").Inc()
+		slog.Warn("Too many messages in flight, dropping message", "component", "workers", "topic", msg.Topic, "max_inflight", o.cfg.MaxInflight)
+		if msg.ack != nil {
+			msg.ack()
+		}
+		return false
+	}
+}
+
+func (o *Orchestrator) releaseInflight() {
+	if o.inflightLimit == nil {
+		return
+	}
+	<-o.inflightLimit
+	inflightMessages.Dec()
+}